@@ -0,0 +1,150 @@
+package etcdhosts_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// hostsCache is the on-disk format of the cache written by GetHosts. The
+// registrations merged into the hosts are kept apart, so they are still
+// marked as Ephemeral once loaded and don't end up in the static hosts.
+type hostsCache struct {
+	Version   int64     `json:"version"`
+	Revision  int64     `json:"revision"`
+	Updated   time.Time `json:"updated"`
+	Hosts     HostList  `json:"hosts"`
+	Ephemeral HostList  `json:"ephemeral,omitempty"`
+}
+
+// WithCache makes GetHosts persist the last successfully fetched hosts to
+// path and serve them, marked as Stale, when etcd can't be reached. A leading
+// "~" in path is expanded to the home dir.
+func WithCache(path string) ClientOption {
+	return func(o *clientOptions) {
+		o.cachePath = path
+	}
+}
+
+// LoadCache returns the hosts stored in the cache, their Revision is the
+// revision they were fetched at and the HostFile is marked as Stale.
+func (hc *HostsClient) LoadCache() (*VHosts, error) {
+	if hc.cachePath == "" {
+		return nil, errors.New("[etcd/cache] cache is not enabled")
+	}
+	bs, err := ioutil.ReadFile(hc.cachePath)
+	if err != nil {
+		return nil, fmt.Errorf("[etcd/cache] read cache file %s failed: %w", hc.cachePath, err)
+	}
+	var cache hostsCache
+	err = json.Unmarshal(bs, &cache)
+	if err != nil {
+		return nil, fmt.Errorf("[etcd/cache] decode cache file %s failed: %w", hc.cachePath, err)
+	}
+
+	hostFile := &HostFile{Hosts: HostList{}, Stale: true}
+	index := newHostIndex(hostFile.Hosts)
+	for _, hostname := range cache.Hosts {
+		// the cached hosts were a valid HostList already
+		_ = hostFile.Hosts.addIndexed(hostname, true, index)
+	}
+	mergeEphemeral(hostFile, cache.Ephemeral, hc.multiAddress)
+	hostFile.Hosts.Sort()
+	return &VHosts{
+		Version:  cache.Version,
+		Revision: cache.Revision,
+		HostFile: hostFile,
+	}, nil
+}
+
+// saveCache atomically replaces the cache file with vh. The file is only
+// rewritten if vh is newer than the hosts written last, or if the ephemeral
+// entries merged into them changed.
+func (hc *HostsClient) saveCache(vh *VHosts) error {
+	cache := hostsCache{
+		Version:   vh.Version,
+		Revision:  vh.Revision,
+		Hosts:     HostList{},
+		Ephemeral: HostList{},
+	}
+	for _, hostname := range vh.HostFile.Hosts {
+		if hostname.Ephemeral {
+			cache.Ephemeral = append(cache.Ephemeral, hostname)
+		} else {
+			cache.Hosts = append(cache.Hosts, hostname)
+		}
+	}
+	hosts, err := json.Marshal([]HostList{cache.Hosts, cache.Ephemeral})
+	if err != nil {
+		return fmt.Errorf("[etcd/cache] encode cache failed: %w", err)
+	}
+	hc.cacheMu.Lock()
+	defer hc.cacheMu.Unlock()
+	if vh.Revision < hc.cacheRevision || (vh.Revision == hc.cacheRevision && bytes.Equal(hosts, hc.cacheHosts)) {
+		return nil
+	}
+
+	cache.Updated = time.Now()
+	bs, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return fmt.Errorf("[etcd/cache] encode cache failed: %w", err)
+	}
+	err = writeFileAtomic(hc.cachePath, bs, 0644)
+	if err != nil {
+		return err
+	}
+	hc.cacheRevision, hc.cacheHosts = vh.Revision, hosts
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file in the same directory and
+// renames it to path, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("[etcd/file] create dir %s failed: %w", dir, err)
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("[etcd/file] create temp file in %s failed: %w", dir, err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("[etcd/file] write file %s failed: %w", path, err)
+	}
+	return nil
+}
+
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("[etcd] failed to get home dir: %w", err)
+	}
+	return strings.Replace(path, "~", home, 1), nil
+}
@@ -2,25 +2,29 @@ package etcdhosts_client
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"runtime"
-	"sort"
-	"strings"
+	"sync"
 	"time"
 
-	"github.com/mitchellh/go-homedir"
 	"go.etcd.io/etcd/clientv3"
 )
 
+// ErrHostsNotExist is returned when the hosts key is not present in etcd.
+var ErrHostsNotExist = errors.New("etcd hosts not exist")
+
 type HostsClient struct {
-	hostKey string
-	cli     *clientv3.Client
+	hostKey        string
+	cli            *clientv3.Client
+	requestTimeout time.Duration
+	layout         StorageLayout
+	multiAddress   bool
+	cachePath      string
+
+	// cacheMu guards the revision and hosts last written to the cache
+	cacheMu       sync.Mutex
+	cacheRevision int64
+	cacheHosts    []byte
 }
 
 type VHosts struct {
@@ -31,110 +35,257 @@ type VHosts struct {
 
 type VHostsList []VHosts
 
+// RevisionConflictError is returned by PutHostsIfRevision when the hosts key
+// has been modified since the expected revision was read. Current holds the
+// remote hosts at the time of the conflict, it is nil if the key was deleted.
+type RevisionConflictError struct {
+	Key      string
+	Expected int64
+	Current  *VHosts
+}
+
+func (e *RevisionConflictError) Error() string {
+	var current int64
+	if e.Current != nil {
+		current = e.Current.Revision
+	}
+	return fmt.Sprintf("[etcd/client/put] hosts revision conflict, key %s: expected %d, current %d", e.Key, e.Expected, current)
+}
+
 func (v VHostsList) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
 func (v VHostsList) Len() int           { return len(v) }
 func (v VHostsList) Less(i, j int) bool { return v[i].Version > v[j].Version }
 
+// NewClient creates a HostsClient using mutual TLS, ca, cert and key may be
+// either file paths or base64 encoded PEM data.
 func NewClient(ca, cert, key string, endpoints []string, hostKey string) (*HostsClient, error) {
 	if ca == "" || cert == "" || key == "" {
 		return nil, errors.New("[etcd] certs config is empty")
 	}
+	return NewClientWithOptions(endpoints, hostKey, WithTLS(ca, cert, key))
+}
 
+// NewClientWithOptions creates a HostsClient configured by opts. Without any
+// TLS option the connection is plaintext.
+func NewClientWithOptions(endpoints []string, hostKey string, opts ...ClientOption) (*HostsClient, error) {
 	if len(endpoints) < 1 {
 		return nil, errors.New("[etcd] endpoints config is empty")
 	}
 
-	var caBs, certBs, keyBs []byte
+	options := defaultClientOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cachePath, err := expandHome(options.cachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:            endpoints,
+		DialTimeout:          options.dialTimeout,
+		DialKeepAliveTime:    options.keepAliveTime,
+		DialKeepAliveTimeout: options.keepAliveTimeout,
+		MaxCallSendMsgSize:   options.maxSendMsgSize,
+		MaxCallRecvMsgSize:   options.maxRecvMsgSize,
+		TLS:                  tlsConfig,
+		Username:             options.username,
+		Password:             options.password,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("[etcd/client] create etcd client failed: %w", err)
+	}
+	return &HostsClient{
+		hostKey:        hostKey,
+		cli:            cli,
+		requestTimeout: options.requestTimeout,
+		layout:         options.layout,
+		multiAddress:   options.multiAddress,
+		cachePath:      cachePath,
+	}, nil
+}
+
+func (hc *HostsClient) PutHosts(hostFile *HostFile) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.requestTimeout)
+	defer cancel()
+	return hc.PutHostsContext(ctx, hostFile)
+}
 
-	// if config is filepath, replace "~" to real home dir
-	home, err := homedir.Dir()
+// PutHostsContext is like PutHosts but uses ctx for the request.
+func (hc *HostsClient) PutHostsContext(ctx context.Context, hostFile *HostFile) error {
+	if hc.layout == LayoutEntries {
+		_, err := hc.putEntries(ctx, hostFile, "", -1)
+		return err
+	}
+	_, err := hc.cli.Put(ctx, hc.hostKey, string(staticData(hostFile)))
 	if err != nil {
-		return nil, fmt.Errorf("[etcd] failed to get home dir: %w", err)
+		return fmt.Errorf("[etcd/client/put] push hosts failed, key %s: %w", hc.hostKey, err)
 	}
+	return nil
+}
 
-	if strings.HasPrefix(ca, "~") {
-		ca = strings.Replace(ca, "~", home, 1)
+// PutHostsIfRevision pushes the hosts only if the key's ModRevision is still
+// modRevision, a modRevision of 0 means the key must not exist yet. It returns
+// the revision of the new version, or a *RevisionConflictError if the key has
+// been changed by someone else.
+func (hc *HostsClient) PutHostsIfRevision(hostFile *HostFile, modRevision int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.requestTimeout)
+	defer cancel()
+	return hc.PutHostsIfRevisionContext(ctx, hostFile, modRevision)
+}
+
+// PutHostsIfRevisionContext is like PutHostsIfRevision but uses ctx for the
+// request.
+func (hc *HostsClient) PutHostsIfRevisionContext(ctx context.Context, hostFile *HostFile, modRevision int64) (int64, error) {
+	return hc.putHostsIfRevision(ctx, hostFile, "", modRevision)
+}
+
+// putHostsIfRevision writes hostFile guarded by modRevision, header is
+// prepended to the stored hosts as is.
+func (hc *HostsClient) putHostsIfRevision(ctx context.Context, hostFile *HostFile, header string, modRevision int64) (int64, error) {
+	if hc.layout == LayoutEntries {
+		return hc.putEntries(ctx, hostFile, header, modRevision)
 	}
-	if strings.HasPrefix(cert, "~") {
-		cert = strings.Replace(cert, "~", home, 1)
+
+	resp, err := hc.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(hc.hostKey), "=", modRevision)).
+		Then(clientv3.OpPut(hc.hostKey, header+string(staticData(hostFile)))).
+		Else(clientv3.OpGet(hc.hostKey)).
+		Commit()
+	if err != nil {
+		return 0, fmt.Errorf("[etcd/client/put] push hosts failed, key %s: %w", hc.hostKey, err)
 	}
-	if strings.HasPrefix(key, "~") {
-		key = strings.Replace(key, "~", home, 1)
+	if resp.Succeeded {
+		return resp.Header.Revision, nil
 	}
 
-	// check config is base64 data or filepath
-	_, err = os.Stat(ca)
-	if err == nil {
-		caBs, err = ioutil.ReadFile(ca)
-		if err != nil {
-			return nil, fmt.Errorf("[etcd/cert] read ca file %s failed: %w", ca, err)
-		}
-		certBs, err = ioutil.ReadFile(cert)
-		if err != nil {
-			return nil, fmt.Errorf("[etcd/cert] read cert file %s failed: %w", cert, err)
-		}
-		keyBs, err = ioutil.ReadFile(key)
-		if err != nil {
-			return nil, fmt.Errorf("[etcd/cert] read key file %s failed: %w", key, err)
-		}
-	} else {
-		caBs, err = base64.StdEncoding.DecodeString(ca)
-		if err != nil {
-			return nil, fmt.Errorf("[etcd/cert] ca base64 decode failed: %w", err)
-		}
-		certBs, err = base64.StdEncoding.DecodeString(cert)
+	conflict := &RevisionConflictError{Key: hc.hostKey, Expected: modRevision}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) > 0 {
+		hostFile, err := decodeHostFile(kvs[0].Value, hc.multiAddress)
 		if err != nil {
-			return nil, fmt.Errorf("[etcd/cert] cert base64 decode failed: %w", err)
+			return 0, fmt.Errorf("[etcd/client/put] parse remote hosts failed, key %s: %w", hc.hostKey, err)
 		}
-		keyBs, err = base64.StdEncoding.DecodeString(key)
-		if err != nil {
-			return nil, fmt.Errorf("[etcd/cert] key base64 decode failed: %w", err)
+		conflict.Current = &VHosts{
+			Version:  kvs[0].Version,
+			Revision: kvs[0].ModRevision,
+			HostFile: hostFile,
 		}
 	}
+	return 0, conflict
+}
 
-	rootCertPool := x509.NewCertPool()
-	rootCertPool.AppendCertsFromPEM(caBs)
+// GetVHosts returns the current hosts together with its version and
+// ModRevision, the revision can be passed to PutHostsIfRevision.
+func (hc *HostsClient) GetVHosts() (*VHosts, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.requestTimeout)
+	defer cancel()
+	return hc.GetVHostsContext(ctx)
+}
 
-	etcdClientCert, err := tls.X509KeyPair(certBs, keyBs)
+// GetVHostsContext is like GetVHosts but uses ctx for the request.
+func (hc *HostsClient) GetVHostsContext(ctx context.Context) (*VHosts, error) {
+	if hc.layout == LayoutEntries {
+		return hc.getEntries(ctx, 0)
+	}
+
+	resp, err := hc.cli.Get(ctx, hc.hostKey)
 	if err != nil {
-		return nil, fmt.Errorf("[etcd/cert] x509 error: %w", err)
+		return nil, fmt.Errorf("[etcd/client/get] get hosts failed, key %s: %w", hc.hostKey, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("[etcd/client/get] %w, key: %s", ErrHostsNotExist, hc.hostKey)
 	}
 
-	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   endpoints,
-		DialTimeout: 5 * time.Second,
-		TLS: &tls.Config{
-			RootCAs:      rootCertPool,
-			Certificates: []tls.Certificate{etcdClientCert},
-		},
-	})
+	hostFile, err := decodeHostFile(resp.Kvs[0].Value, hc.multiAddress)
 	if err != nil {
-		return nil, fmt.Errorf("[etcd/client] create etcd client failed: %w", err)
+		return nil, err
 	}
-	return &HostsClient{
-		hostKey: hostKey,
-		cli:     cli,
+	return &VHosts{
+		Version:  resp.Kvs[0].Version,
+		Revision: resp.Kvs[0].ModRevision,
+		HostFile: hostFile,
 	}, nil
 }
 
-func (hc *HostsClient) PutHosts(hostFile *HostFile) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetHosts returns the current hosts merged with the entries registered by
+// RegisterHost. The merged entries are marked as Ephemeral and are left out
+// when the HostFile is pushed again.
+//
+// If a cache is configured with WithCache, the result is written to the cache
+// when it changed and when etcd can't be reached the cached hosts are
+// returned instead, marked as Stale.
+func (hc *HostsClient) GetHosts() (*HostFile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.requestTimeout)
 	defer cancel()
+	return hc.getHosts(ctx, context.Background())
+}
+
+// GetHostsContext is like GetHosts but uses ctx for the request. Once ctx is
+// done its error is returned instead of the cached hosts.
+func (hc *HostsClient) GetHostsContext(ctx context.Context) (*HostFile, error) {
+	return hc.getHosts(ctx, ctx)
+}
 
-	_, err := hc.cli.Put(ctx, hc.hostKey, string(hostFile.Format(runtime.GOOS)))
+// getHosts reads the hosts with ctx and falls back to the cache unless
+// caller, the context the caller passed in, is done.
+func (hc *HostsClient) getHosts(ctx, caller context.Context) (*HostFile, error) {
+	vh, err := hc.getMergedHosts(ctx)
 	if err != nil {
-		return fmt.Errorf("[etcd/client/put] push hosts failed, key %s: %w", hc.hostKey, err)
+		if hc.cachePath == "" || errors.Is(err, ErrHostsNotExist) || caller.Err() != nil {
+			return nil, err
+		}
+		cached, cacheErr := hc.LoadCache()
+		if cacheErr != nil {
+			return nil, err
+		}
+		return cached.HostFile, nil
 	}
-	return nil
+	if hc.cachePath != "" {
+		// the cache is best effort, a failed write must not fail the read
+		_ = hc.saveCache(vh)
+	}
+	return vh.HostFile, nil
 }
 
-func (hc *HostsClient) GetHosts() (*HostFile, error) {
-	return hc.GetHostsWithRevision(-1)
+func (hc *HostsClient) getMergedHosts(ctx context.Context) (*VHosts, error) {
+	vh, err := hc.GetVHostsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := hc.GetEphemeralHosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mergeEphemeral(vh.HostFile, ephemeral, hc.multiAddress)
+	return vh, nil
 }
 
 func (hc *HostsClient) GetHostsWithRevision(revision int64) (*HostFile, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), hc.requestTimeout)
 	defer cancel()
+	return hc.GetHostsWithRevisionContext(ctx, revision)
+}
+
+// GetHostsWithRevisionContext is like GetHostsWithRevision but uses ctx for
+// the request.
+func (hc *HostsClient) GetHostsWithRevisionContext(ctx context.Context, revision int64) (*HostFile, error) {
+	if hc.layout == LayoutEntries {
+		if revision < 0 {
+			revision = 0
+		}
+		vh, err := hc.getEntries(ctx, revision)
+		if err != nil {
+			return nil, err
+		}
+		return vh.HostFile, nil
+	}
 
 	var resp *clientv3.GetResponse
 	var err error
@@ -149,51 +300,28 @@ func (hc *HostsClient) GetHostsWithRevision(revision int64) (*HostFile, error) {
 	}
 
 	if len(resp.Kvs) == 0 {
-		return nil, fmt.Errorf("[etcd/client/get] etcd hosts not exist, key: %s", hc.hostKey)
+		return nil, fmt.Errorf("[etcd/client/get] %w, key: %s", ErrHostsNotExist, hc.hostKey)
 	}
 
 	if len(resp.Kvs) > 1 {
 		return nil, fmt.Errorf("[etcd/client/get] too many etcd hosts, key: %s", hc.hostKey)
 	}
 
-	return NewHostFile(resp.Kvs[0].Value)
+	return decodeHostFile(resp.Kvs[0].Value, hc.multiAddress)
 }
 
-func (hc *HostsClient) GetHostsHistory() (VHostsList, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	getResp, err := hc.cli.Get(ctx, hc.hostKey)
-	if err != nil {
-		return nil, fmt.Errorf("[etcd/client/get] get hosts failed, key %s: %w", hc.hostKey, err)
-	}
-	if len(getResp.Kvs) < 1 {
-		return nil, fmt.Errorf("[etcd/client/get] kvs not found, key %s", hc.hostKey)
-	}
+func (hc *HostsClient) Watch() clientv3.WatchChan {
+	return hc.cli.Watch(context.Background(), hc.hostKey)
+}
 
-	vl := VHostsList{}
-	for i := getResp.Header.Revision; i > 0; i-- {
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		resp, err := hc.cli.Get(ctx, hc.hostKey, clientv3.WithRev(i))
-		if err != nil {
-			cancel()
-			break
-		}
-		hostFile, err := NewHostFile(resp.Kvs[0].Value)
-		if err != nil {
-			cancel()
-			break
-		}
-		vl = append(vl, VHosts{
-			Version:  resp.Kvs[0].Version,
-			Revision: i,
-			HostFile: hostFile,
-		})
-		cancel()
-	}
-	sort.Sort(vl)
-	return vl, nil
+// WatchContext is like Watch but the returned channel is closed and the
+// underlying watcher released once ctx is done.
+func (hc *HostsClient) WatchContext(ctx context.Context) clientv3.WatchChan {
+	return hc.cli.Watch(ctx, hc.hostKey)
 }
 
-func (hc *HostsClient) Watch() clientv3.WatchChan {
-	return hc.cli.Watch(context.Background(), hc.hostKey)
+// Close shuts down the underlying etcd client, all watch channels are closed
+// and pending requests fail.
+func (hc *HostsClient) Close() error {
+	return hc.cli.Close()
 }
@@ -1,7 +1,23 @@
 package etcdhosts_client
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/mritd/etcdhosts-client/internal/etcdtest"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/embed"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
 )
 
 var (
@@ -204,3 +220,2028 @@ func TestHostList_RemoveDomain(t *testing.T) {
 		t.Fatal("HostList_RemoveDomain test failed")
 	}
 }
+
+func TestRevisionConflictError(t *testing.T) {
+	var err error = &RevisionConflictError{Key: testHostkey, Expected: 3, Current: &VHosts{Revision: 5}}
+	var conflict *RevisionConflictError
+	if !errors.As(fmt.Errorf("wrapped: %w", err), &conflict) {
+		t.Fatal("RevisionConflictError errors.As test failed")
+	}
+	if conflict.Current.Revision != 5 {
+		t.Fatal("RevisionConflictError test failed")
+	}
+}
+
+func TestHostsClient_NewClientWithOptions(t *testing.T) {
+	cli, err := NewClientWithOptions([]string{"http://127.0.0.1:2379"}, testHostkey,
+		WithDialTimeout(time.Second),
+		WithRequestTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = cli.Close()
+
+	cli, err = NewClientWithOptions(testEndpoints, testHostkey, WithCA(testCA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = cli.Close()
+}
+
+func TestHostFile_RollbackOf(t *testing.T) {
+	hostFile, err := NewHostFile([]byte("# etcdhosts: rollback of revision 12\n1.1.1.1 baidu.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostFile.RollbackOf() != 12 {
+		t.Fatal("HostFile_RollbackOf test failed")
+	}
+	if len(hostFile.Hosts) != 1 {
+		t.Fatal("HostFile_RollbackOf test failed")
+	}
+}
+
+func TestMergeEphemeral(t *testing.T) {
+	hostFile, err := NewHostFile([]byte("1.1.1.1 baidu.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergeEphemeral(hostFile, []*Hostname{
+		MustHostname("baidu.com", "2.2.2.2", true),
+		MustHostname("worker-123.internal", "10.0.4.17", true),
+	}, false)
+	if len(hostFile.Hosts.FilterByDomain("baidu.com")) != 1 || !hostFile.Hosts.ContainsDomain("worker-123.internal") {
+		t.Fatal("MergeEphemeral test failed")
+	}
+	if string(staticData(hostFile)) != "1.1.1.1 baidu.com\n" {
+		t.Fatal("MergeEphemeral test failed")
+	}
+	for _, hostname := range hostFile.Hosts {
+		if hostname.Ephemeral != (hostname.Domain == "worker-123.internal") {
+			t.Fatalf("MergeEphemeral flag test failed: %s", hostname.Format())
+		}
+	}
+
+	// registrations merged into sorted hosts must not mark static entries
+	hostFile, err = NewHostFile([]byte("1.1.1.1 b.internal\n2.2.2.2 c.internal\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergeEphemeral(hostFile, []*Hostname{MustHostname("a.internal", "3.3.3.3", true)}, false)
+	hostFile.Hosts.Sort()
+	mergeEphemeral(hostFile, []*Hostname{MustHostname("d.internal", "4.4.4.4", true)}, false)
+	for _, hostname := range hostFile.Hosts {
+		ephemeral := hostname.Domain == "a.internal" || hostname.Domain == "d.internal"
+		if hostname.Ephemeral != ephemeral {
+			t.Fatalf("MergeEphemeral static flag test failed: %s", hostname.Format())
+		}
+	}
+
+	// every registration of a domain is merged, not only the first one
+	registered := []*Hostname{
+		MustHostname("worker.internal", "10.0.4.17", true),
+		MustHostname("worker.internal", "10.0.4.18", true),
+	}
+	for multi, expected := range map[bool]string{
+		true:  "10.0.4.17 worker.internal\n10.0.4.18 worker.internal\n",
+		false: "10.0.4.18 worker.internal\n",
+	} {
+		hostFile = &HostFile{Hosts: HostList{}}
+		mergeEphemeral(hostFile, registered, multi)
+		hostFile.Hosts.Sort()
+		if string(hostFile.Hosts.Format("linux")) != expected {
+			t.Fatalf("MergeEphemeral multi %t test failed: %q", multi, hostFile.Hosts.Format("linux"))
+		}
+	}
+}
+
+func TestHostsClient_parseEntryKey(t *testing.T) {
+	hc := &HostsClient{hostKey: testHostkey, layout: LayoutEntries}
+	generation, domain, version, ok := hc.parseEntryKey(hc.entryKey("", "baidu.com", "6"))
+	if !ok || generation != "" || domain != "baidu.com" || version != 6 {
+		t.Fatal("HostsClient_parseEntryKey test failed")
+	}
+	generation, domain, version, ok = hc.parseEntryKey(hc.entryKey("0a1b", "baidu.com", "4"))
+	if !ok || generation != "0a1b" || domain != "baidu.com" || version != 4 {
+		t.Fatal("HostsClient_parseEntryKey generation test failed")
+	}
+	for _, key := range []string{
+		hc.ephemeralKey(MustHostname("baidu.com", "1.1.1.1", true), 0x1f),
+		hc.generationKey(),
+		testHostkey,
+	} {
+		if _, _, _, ok = hc.parseEntryKey(key); ok {
+			t.Fatalf("HostsClient_parseEntryKey test failed: %s", key)
+		}
+	}
+}
+
+func TestHostsClient_GetHostsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcdhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cli, err := NewClientWithOptions([]string{"http://127.0.0.1:1"}, testHostkey,
+		WithCache(filepath.Join(dir, "hosts.json")),
+		WithRequestTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	hostFile, err := NewHostFile([]byte(`1.1.1.1 baidu.com`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cli.saveCache(&VHosts{Version: 1, Revision: 42, HostFile: hostFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := cli.GetHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached.Stale || !cached.Hosts.ContainsDomain("baidu.com") {
+		t.Fatal("HostsClient_GetHostsCache test failed")
+	}
+	vh, err := cli.LoadCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vh.Revision != 42 {
+		t.Fatal("HostsClient_GetHostsCache test failed")
+	}
+
+	// registrations stay ephemeral through the cache, pushing the cached
+	// hosts must not make them permanent
+	mergeEphemeral(hostFile, []*Hostname{MustHostname("worker.internal", "10.0.4.17", true)}, false)
+	err = cli.saveCache(&VHosts{Version: 1, Revision: 43, HostFile: hostFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vh, err = cli.LoadCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vh.HostFile.Hosts) != 2 || vh.Revision != 43 {
+		t.Fatalf("HostsClient_GetHostsCache ephemeral test failed: %q", vh.HostFile.Hosts.Format("linux"))
+	}
+	for _, hostname := range vh.HostFile.Hosts {
+		if hostname.Ephemeral != (hostname.Domain == "worker.internal") {
+			t.Fatalf("HostsClient_GetHostsCache ephemeral flag test failed: %s", hostname.Format())
+		}
+	}
+	if string(staticData(vh.HostFile)) != "1.1.1.1 baidu.com\n" {
+		t.Fatalf("HostsClient_GetHostsCache ephemeral test failed: %q", staticData(vh.HostFile))
+	}
+}
+
+func TestReplaceSyncBlock(t *testing.T) {
+	block := []byte(SyncBeginMarker + "\n1.1.1.1 baidu.com\n" + SyncEndMarker + "\n")
+	content := []byte("127.0.0.1 localhost\n# keep me\n")
+
+	appended := ReplaceSyncBlock(content, block)
+	if string(appended) != string(content)+string(block) {
+		t.Fatal("ReplaceSyncBlock test failed")
+	}
+
+	updated := ReplaceSyncBlock(append(appended, "::1 localhost\n"...),
+		[]byte(SyncBeginMarker+"\n2.2.2.2 baidu.com\n"+SyncEndMarker+"\n"))
+	expected := "127.0.0.1 localhost\n# keep me\n" + SyncBeginMarker + "\n2.2.2.2 baidu.com\n" + SyncEndMarker + "\n::1 localhost\n"
+	if string(updated) != expected {
+		t.Fatal("ReplaceSyncBlock test failed")
+	}
+}
+
+func TestSyncer_Apply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcdhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	target := filepath.Join(dir, "hosts")
+	err = ioutil.WriteFile(target, []byte("127.0.0.1 localhost\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostFile, err := NewHostFile([]byte(`1.1.1.1 baidu.com`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncer := NewSyncer(nil, target)
+	err = syncer.Apply(hostFile, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "127.0.0.1 localhost\n"+SyncBeginMarker+"\n1.1.1.1 baidu.com\n"+SyncEndMarker+"\n" {
+		t.Fatal("Syncer_Apply test failed")
+	}
+	bs, err = ioutil.ReadFile(syncer.Backup)
+	if err != nil || string(bs) != "127.0.0.1 localhost\n" {
+		t.Fatal("Syncer_Apply backup test failed")
+	}
+	if syncer.LastRevision() != 7 {
+		t.Fatal("Syncer_Apply test failed")
+	}
+}
+
+func TestSyncer_ApplyNoTrailingNewline(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "hosts")
+	err := ioutil.WriteFile(target, []byte("127.0.0.1 localhost\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hosts from etcd are parsed losslessly, a value without a final newline
+	// also formats without one
+	hostFile, err := decodeHostFile([]byte("1.1.1.1 baidu.com"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncer := NewSyncer(nil, target)
+	for i := 0; i < 2; i++ {
+		if err = syncer.Apply(hostFile, int64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bs, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "127.0.0.1 localhost\n"+SyncBeginMarker+"\n1.1.1.1 baidu.com\n"+SyncEndMarker+"\n" {
+		t.Fatalf("Syncer_ApplyNoTrailingNewline test failed: %q", bs)
+	}
+}
+
+func TestNewHostFileWithOptions_Preserve(t *testing.T) {
+	hostFile, err := NewHostFileWithOptions([]byte(DefaultOSX), ParseOptions{Preserve: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(hostFile.Format("linux")) != DefaultOSX {
+		t.Fatal("NewHostFileWithOptions_Preserve round trip test failed")
+	}
+
+	// duplicates and conflicts across lines don't rewrite any line, the
+	// hosts are those of a parse without Preserve
+	for data, hosts := range map[string]string{
+		"#127.0.0.1 localhost\n127.0.0.1 localhost\n": "127.0.0.1 localhost\n",
+		"1.1.1.1 a\n1.1.1.1 a # note\n":               "1.1.1.1 a\n",
+		"1.1.1.1 a\n2.2.2.2 a\n1.1.1.1 a\n":           "1.1.1.1 a\n",
+	} {
+		hostFile, err = NewHostFileWithOptions([]byte(data), ParseOptions{Preserve: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(hostFile.Format("linux")) != data || string(hostFile.Clone().Format("linux")) != data {
+			t.Fatalf("NewHostFileWithOptions_Preserve duplicate round trip test failed: %q", hostFile.Format("linux"))
+		}
+		if string(hostFile.Hosts.Format("linux")) != hosts {
+			t.Fatalf("NewHostFileWithOptions_Preserve duplicate hosts test failed: %q", hostFile.Hosts.Format("linux"))
+		}
+	}
+
+	data := "# office\n1.1.1.1 baidu.com qq.com # owner: ops\n\n2.2.2.2 google.com\n"
+	hostFile, err = NewHostFileWithOptions([]byte(data), ParseOptions{Preserve: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostFile.Hosts.RemoveDomain("qq.com")
+	err = hostFile.Hosts.Disable("google.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hostFile.Hosts.Add(MustHostname("bing.com", "3.3.3.3", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# office\n1.1.1.1 baidu.com # owner: ops\n\n# 2.2.2.2 google.com\n3.3.3.3 bing.com\n"
+	if string(hostFile.Format("linux")) != expected {
+		t.Fatalf("NewHostFileWithOptions_Preserve edit test failed: %q", hostFile.Format("linux"))
+	}
+
+	// a new address of an entry is written in place, next to its comments
+	data = "# office\n1.1.1.1 baidu.com qq.com # owner: ops\n\n# backup\n2.2.2.2 google.com\n3.3.3.3 bing.com\n"
+	hostFile, err = NewHostFileWithOptions([]byte(data), ParseOptions{Preserve: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = hostFile.Hosts.Add(MustHostname("google.com", "4.4.4.4", true)); !errors.Is(err, ErrConflictingHostname) {
+		t.Fatalf("NewHostFileWithOptions_Preserve change IP test failed: %v", err)
+	}
+	_ = hostFile.Hosts.Add(MustHostname("qq.com", "5.5.5.5", true))
+	expected = "# office\n1.1.1.1 baidu.com # owner: ops\n5.5.5.5 qq.com\n\n# backup\n4.4.4.4 google.com\n3.3.3.3 bing.com\n"
+	if string(hostFile.Format("linux")) != expected {
+		t.Fatalf("NewHostFileWithOptions_Preserve change IP test failed: %q", hostFile.Format("linux"))
+	}
+	reparsed, err := NewHostFileWithOptions(hostFile.Format("linux"), ParseOptions{Preserve: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reparsed.Format("linux")) != expected ||
+		string(reparsed.Hosts.Format("linux")) != string(hostFile.Hosts.Format("linux")) {
+		t.Fatalf("NewHostFileWithOptions_Preserve change IP round trip test failed: %q", reparsed.Format("linux"))
+	}
+}
+
+func TestNewHostFileWithOptions_Strict(t *testing.T) {
+	data := "# etcdhosts: rollback of revision 3\n1.1.1.1 baidu.com\n1.1.1.1 baidu.com\n1.1.1 qq.com\n2.2.2.2 bad!domain\n"
+	hostFile, err := NewHostFile([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings := hostFile.Warnings()
+	if len(warnings) != 3 || warnings[0].Kind != ParseErrDuplicate || warnings[1].Kind != ParseErrInvalidIP || warnings[2].Kind != ParseErrInvalidDomain {
+		t.Fatalf("NewHostFileWithOptions_Strict lenient test failed: %v", warnings)
+	}
+	if warnings[2].Line != 5 || warnings[2].Column != 9 || warnings[2].Text != "bad!domain" {
+		t.Fatalf("NewHostFileWithOptions_Strict position test failed: %v", warnings[2])
+	}
+	if !errors.Is(warnings[0], ErrDuplicateHostname) || len(hostFile.Hosts) != 2 {
+		t.Fatal("NewHostFileWithOptions_Strict duplicate test failed")
+	}
+
+	_, err = NewHostFileWithOptions([]byte(data), ParseOptions{Strict: true})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Line != 4 || parseErr.Column != 1 || parseErr.Kind != ParseErrInvalidIP {
+		t.Fatalf("NewHostFileWithOptions_Strict strict test failed: %v", err)
+	}
+}
+
+func TestNewHostname_IP(t *testing.T) {
+	for _, ip := range []string{"999.1.1.1", "(:)", "1.1.1.1%eth0", "fe80::1%", "1.1.1"} {
+		if _, err := NewHostname("baidu.com", ip, true); err == nil {
+			t.Fatalf("NewHostname_IP invalid %s test failed", ip)
+		}
+	}
+	if LooksLikeIPv4("999.1.1.1") || LooksLikeIPv6("(:)") || !LooksLikeIPv6("::ffff:10.0.0.1") || LooksLikeIPv4("::ffff:10.0.0.1") {
+		t.Fatal("NewHostname_IP LooksLike test failed")
+	}
+
+	hostFile, err := NewHostFile([]byte(DefaultOSX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the zone-scoped address doesn't replace the global one
+	localhost := hostFile.Hosts.FilterByDomainV("localhost", 6)
+	if len(localhost) != 2 || len(hostFile.Warnings()) != 0 || !hostFile.Hosts.Contains(MustHostname("localhost", "::1", true)) {
+		t.Fatalf("NewHostname_IP ::1 test failed: %v", localhost)
+	}
+	zoned := localhost[0]
+	if localhost[1].Zone != "" {
+		zoned = localhost[1]
+	}
+	if zoned.Zone != "lo0" || zoned.Format() != "fe80::1%lo0 localhost" {
+		t.Fatalf("NewHostname_IP zone test failed: %s", zoned.Format())
+	}
+	if hostFile.Hosts.Add(MustHostname("localhost", "fe80::2%lo0", true)) == nil || len(hostFile.Hosts.FilterByDomainV("localhost", 6)) != 2 {
+		t.Fatal("NewHostname_IP zone conflict test failed")
+	}
+
+	mapped := MustHostname("baidu.com", "::ffff:10.0.0.1", true)
+	plain := MustHostname("baidu.com", "10.0.0.1", true)
+	if !mapped.IPv6 || mapped.Format() != "::ffff:10.0.0.1 baidu.com" || mapped.Equal(plain) {
+		t.Fatal("NewHostname_IP mapped test failed")
+	}
+	hosts := HostList{}
+	if hosts.Add(mapped) != nil || hosts.Add(plain) != nil || len(hosts) != 2 {
+		t.Fatal("NewHostname_IP mapped add test failed")
+	}
+
+	dump, err := hosts.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := HostList{}
+	if err = applied.Apply(dump); err != nil {
+		t.Fatal(err)
+	}
+	if string(applied.Format("linux")) != "10.0.0.1 baidu.com\n::ffff:10.0.0.1 baidu.com\n" {
+		t.Fatalf("NewHostname_IP dump test failed: %q", applied.Format("linux"))
+	}
+}
+
+func TestValidateDomain(t *testing.T) {
+	for _, domain := range []string{"bai du.com", "baidu.com.", strings.Repeat("a", 64) + ".com", "", "a..com", "a/b.com", "_ephemeral", "_generation"} {
+		if _, err := NewHostname(domain, "1.1.1.1", true); !errors.Is(err, ErrInvalidDomain) {
+			t.Fatalf("ValidateDomain %q test failed: %v", domain, err)
+		}
+	}
+	if ValidateDomain("my_host.local", DomainHostname) != nil || ValidateDomain("my_host.local", DomainRFC1123) == nil ||
+		ValidateDomain("-a.com", DomainRFC1123) == nil {
+		t.Fatal("ValidateDomain level test failed")
+	}
+	_, err := NewHostFileWithOptions([]byte("1.1.1.1 my_host.local\n"), ParseOptions{Strict: true, Domains: DomainRFC1123})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Kind != ParseErrInvalidDomain {
+		t.Fatalf("ValidateDomain strict parse test failed: %v", err)
+	}
+
+	hostname := MustHostname("Bücher.example", "1.1.1.1", true)
+	if hostname.Domain != "xn--bcher-kva.example" || hostname.Format() != "1.1.1.1 xn--bcher-kva.example" ||
+		hostname.FormatHuman() != "bücher.example -> 1.1.1.1 (On)" {
+		t.Fatalf("ValidateDomain idn test failed: %s", hostname.FormatHuman())
+	}
+
+	hosts := HostList{}
+	_ = hosts.Add(hostname)
+	_ = hosts.Add(MustHostname("d.com", "2.2.2.2", true))
+	_ = hosts.Add(MustHostname("C.com", "2.2.2.2", true))
+	_ = hosts.Add(MustHostname("b.com", "2.2.2.2", true))
+	if !hosts.ContainsDomain("BÜCHER.example") || len(hosts.FilterByDomain("c.COM")) != 1 || !hosts.Contains(MustHostname("D.com", "2.2.2.2", true)) {
+		t.Fatal("ValidateDomain case test failed")
+	}
+	if hosts.Add(MustHostname("B.COM", "3.3.3.3", true)) == nil || len(hosts) != 4 {
+		t.Fatal("ValidateDomain case conflict test failed")
+	}
+	hosts.Sort()
+	if string(hosts.Format("linux")) != "1.1.1.1 xn--bcher-kva.example\n2.2.2.2 C.com d.com\n3.3.3.3 B.COM\n" {
+		t.Fatalf("ValidateDomain sort test failed: %q", hosts.Format("linux"))
+	}
+}
+
+func TestHostname_Comment(t *testing.T) {
+	hostFile, err := NewHostFile([]byte("1.1.1.1 baidu.com qq.com # owner=ops ticket=OPS-12\n1.1.1.1 google.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname := hostFile.Hosts.FilterByDomain("baidu.com")[0]
+	if hostname.Comment != "owner=ops ticket=OPS-12" || hostname.Metadata["ticket"] != "OPS-12" {
+		t.Fatal("Hostname_Comment parse test failed")
+	}
+	expected := "1.1.1.1 baidu.com qq.com # owner=ops ticket=OPS-12\n1.1.1.1 google.com\n"
+	if string(hostFile.Format("linux")) != expected {
+		t.Fatalf("Hostname_Comment format test failed: %q", hostFile.Format("linux"))
+	}
+
+	hostname.Metadata["reviewed"] = "yes"
+	if hostname.Format() != "1.1.1.1 baidu.com # owner=ops ticket=OPS-12 reviewed=yes" {
+		t.Fatal("Hostname_Comment metadata test failed")
+	}
+
+	dump, err := hostFile.Hosts.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := HostList{}
+	err = applied.Apply(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied.FilterByDomain("baidu.com")[0].Metadata["reviewed"] != "yes" {
+		t.Fatal("Hostname_Comment dump test failed")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, err := NewHostFile([]byte("1.1.1.1 baidu.com\n2.2.2.2 qq.com\n3.3.3.3 google.com\n# 4.4.4.4 bing.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewHostFile([]byte("1.1.1.1 baidu.com\n5.5.5.5 qq.com\n4.4.4.4 bing.com\n6.6.6.6 github.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, change := range Diff(a, b) {
+		got = append(got, change.Type.String()+" "+change.Domain)
+	}
+	expected := []string{"enabled bing.com", "added github.com", "removed google.com", "ip-changed qq.com"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("Diff test failed: %v", got)
+	}
+
+	diff := UnifiedDiff("a", a, "b", b)
+	expectedDiff := `--- a
++++ b
+@@ -1,4 +1,4 @@
+ 1.1.1.1 baidu.com
+-2.2.2.2 qq.com
+-3.3.3.3 google.com
+-# 4.4.4.4 bing.com
++4.4.4.4 bing.com
++5.5.5.5 qq.com
++6.6.6.6 github.com
+`
+	if diff != expectedDiff {
+		t.Fatalf("UnifiedDiff test failed:\n%s", diff)
+	}
+	if UnifiedDiff("a", a, "b", a) != "" {
+		t.Fatal("UnifiedDiff test failed")
+	}
+
+	// domains match ignoring case but are reported as written
+	a, err = NewHostFile([]byte("1.1.1.1 Example.COM\n2.2.2.2 Old.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = NewHostFile([]byte("3.3.3.3 example.Com\n4.4.4.4 New.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, change := range Diff(a, b) {
+		got = append(got, change.Type.String()+" "+change.Domain)
+	}
+	expected = []string{"ip-changed example.Com", "added New.example.com", "removed Old.example.com"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("Diff case test failed: %v", got)
+	}
+}
+
+func TestDiff_Large(t *testing.T) {
+	a := make([]string, 200000)
+	for i := range a {
+		a[i] = fmt.Sprintf("10.%d.%d.%d host%d.example.com", i>>16&0xff, i>>8&0xff, i&0xff, i)
+	}
+	b := append([]string(nil), a...)
+	b[1000] = "# " + b[1000]
+	b = append(b[:50000], b[50010:]...)
+	b = append(b[:150000], append([]string{"10.255.0.1 new.example.com"}, b[150000:]...)...)
+	other := make([]string, len(a))
+	for i := range other {
+		other[i] = fmt.Sprintf("172.16.%d.%d other%d.example.com", i>>8&0xff, i&0xff, i)
+	}
+
+	for _, tc := range []struct {
+		b                 []string
+		deleted, inserted int
+	}{
+		{b, 11, 2},
+		// a complete rewrite falls back to replacing all lines
+		{other, len(a), len(other)},
+	} {
+		var gotA, gotB []string
+		deleted, inserted := 0, 0
+		for _, op := range diffLines(a, tc.b) {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+			switch op.kind {
+			case '-':
+				deleted++
+			case '+':
+				inserted++
+			}
+		}
+		if strings.Join(gotA, "\n") != strings.Join(a, "\n") || strings.Join(gotB, "\n") != strings.Join(tc.b, "\n") {
+			t.Fatal("Diff_Large edit script does not reproduce the inputs")
+		}
+		if deleted != tc.deleted || inserted != tc.inserted {
+			t.Fatalf("Diff_Large test failed: %d deleted, %d inserted", deleted, inserted)
+		}
+	}
+
+	diff := unifiedDiff("a", a, "b", b)
+	if strings.Count(diff, "@@ -") != 3 || !strings.Contains(diff, "@@ -998,7 +998,7 @@\n") {
+		t.Fatalf("Diff_Large unified diff test failed:\n%s", diff)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base, err := NewHostFile([]byte("1.1.1.1 baidu.com\n2.2.2.2 qq.com\n3.3.3.3 google.com\n4.4.4.4 bing.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours, err := NewHostFile([]byte("1.1.1.1 baidu.com\n5.5.5.5 qq.com\n3.3.3.3 google.com\n7.7.7.7 bing.com\n8.8.8.8 github.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := NewHostFileWithOptions([]byte("# theirs\n1.1.1.1 baidu.com\n2.2.2.2 qq.com\n# 3.3.3.3 google.com\n6.6.6.6 bing.com\n"), ParseOptions{Preserve: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, conflicts := Merge(base, ours, theirs)
+	if len(conflicts) != 1 || conflicts[0].Domain != "bing.com" || !conflicts[0].Theirs.IP.Equal(net.ParseIP("6.6.6.6")) {
+		t.Fatalf("Merge conflicts test failed: %v", conflicts)
+	}
+	expected := "# theirs\n1.1.1.1 baidu.com\n5.5.5.5 qq.com\n# 3.3.3.3 google.com\n7.7.7.7 bing.com\n8.8.8.8 github.com\n"
+	if string(merged.Format("linux")) != expected {
+		t.Fatalf("Merge test failed: %q", merged.Format("linux"))
+	}
+	if !theirs.Hosts.FilterByDomain("qq.com")[0].IP.Equal(net.ParseIP("2.2.2.2")) {
+		t.Fatal("Merge must not modify theirs")
+	}
+
+	// a comment changed by one side merges with an address changed by the other
+	ours, err = NewHostFile([]byte("1.1.1.1 baidu.com # owner=ops\n2.2.2.2 qq.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err = NewHostFile([]byte("9.9.9.9 baidu.com\n2.2.2.2 qq.com # owner=dev\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err = NewHostFile([]byte("1.1.1.1 baidu.com\n2.2.2.2 qq.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, conflicts = Merge(base, ours, theirs)
+	expected = "2.2.2.2 qq.com # owner=dev\n9.9.9.9 baidu.com # owner=ops\n"
+	if len(conflicts) != 0 || string(merged.Format("linux")) != expected {
+		t.Fatalf("Merge comment test failed: %v %q", conflicts, merged.Format("linux"))
+	}
+	ours, err = NewHostFile([]byte("1.1.1.1 baidu.com # owner=ops\n8.8.8.8 qq.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, conflicts = Merge(base, ours, theirs)
+	expected = "8.8.8.8 qq.com\n9.9.9.9 baidu.com # owner=ops\n"
+	if len(conflicts) != 0 || string(merged.Format("linux")) != expected {
+		t.Fatalf("Merge comment test failed: %v %q", conflicts, merged.Format("linux"))
+	}
+
+	// domains match ignoring case but conflicts report them as written by
+	// ours, or by theirs if ours removed the entry
+	base, err = NewHostFile([]byte("1.1.1.1 baidu.com\n2.2.2.2 qq.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours, err = NewHostFile([]byte("5.5.5.5 Baidu.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err = NewHostFile([]byte("6.6.6.6 BAIDU.com\n7.7.7.7 QQ.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, conflicts = Merge(base, ours, theirs)
+	if len(conflicts) != 2 || conflicts[0].Domain != "Baidu.com" || conflicts[1].Domain != "QQ.com" {
+		t.Fatalf("Merge case test failed: %v", conflicts)
+	}
+	multi := ParseOptions{MultiAddress: true}
+	if base, err = NewHostFileWithOptions([]byte("1.1.1.1 api.internal\n2.2.2.2 api.internal\n"), multi); err != nil {
+		t.Fatal(err)
+	}
+	if ours, err = NewHostFileWithOptions([]byte("1.1.1.1 API.internal\n# 2.2.2.2 API.internal\n"), multi); err != nil {
+		t.Fatal(err)
+	}
+	if theirs, err = NewHostFileWithOptions([]byte("1.1.1.1 api.internal\n"), multi); err != nil {
+		t.Fatal(err)
+	}
+	_, conflicts = Merge(base, ours, theirs)
+	if len(conflicts) != 1 || conflicts[0].Domain != "API.internal" {
+		t.Fatalf("Merge address case test failed: %v", conflicts)
+	}
+}
+
+func TestHostList_AddAddress(t *testing.T) {
+	hosts := HostList{}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if err := hosts.AddAddress(MustHostname("api.internal", ip, true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hosts.AddAddress(MustHostname("api.internal", "10.0.0.2", true)) == nil || len(hosts.FilterByDomainV("api.internal", 4)) != 3 {
+		t.Fatal("HostList_AddAddress test failed")
+	}
+	if fmt.Sprint(hosts.IndicesOfDomainV("api.internal", 4)) != "[0 1 2]" {
+		t.Fatal("HostList_AddAddress indices test failed")
+	}
+	if err := hosts.DisableV("api.internal", 4); err != nil {
+		t.Fatal(err)
+	}
+	for _, hostname := range hosts {
+		if hostname.Enabled {
+			t.Fatal("HostList_AddAddress disable test failed")
+		}
+	}
+	if err := hosts.EnableV("api.internal", 4); err != nil {
+		t.Fatal(err)
+	}
+	if string(hosts.Format("linux")) != "10.0.0.1 api.internal\n10.0.0.2 api.internal\n10.0.0.3 api.internal\n" {
+		t.Fatalf("HostList_AddAddress format test failed: %q", hosts.Format("linux"))
+	}
+	if hosts.Add(MustHostname("api.internal", "10.0.0.4", true)) == nil || len(hosts) != 1 {
+		t.Fatal("HostList_AddAddress replace test failed")
+	}
+
+	data := "10.0.0.1 api.internal\n10.0.0.2 api.internal\n"
+	single, err := NewHostFile([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi, err := NewHostFileWithOptions([]byte(data), ParseOptions{MultiAddress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(single.Hosts) != 1 || len(multi.Hosts) != 2 || len(multi.Warnings()) != 0 {
+		t.Fatal("HostList_AddAddress parse test failed")
+	}
+
+	changed := multi.Clone()
+	changed.Hosts.RemoveDomainV("api.internal", 4)
+	_ = changed.Hosts.AddAddress(MustHostname("api.internal", "10.0.0.2", true))
+	_ = changed.Hosts.AddAddress(MustHostname("api.internal", "10.0.0.3", true))
+	var got []string
+	for _, change := range Diff(multi, changed) {
+		got = append(got, change.String())
+	}
+	if fmt.Sprint(got) != "[- api.internal -> 10.0.0.1 + api.internal -> 10.0.0.3 (On)]" {
+		t.Fatalf("HostList_AddAddress diff test failed: %v", got)
+	}
+
+	merged, conflicts := Merge(multi, changed, multi)
+	if len(conflicts) != 0 || string(merged.Format("linux")) != "10.0.0.2 api.internal\n10.0.0.3 api.internal\n" {
+		t.Fatalf("HostList_AddAddress merge test failed: %q %v", merged.Format("linux"), conflicts)
+	}
+
+	decoded, err := decodeHostnames([]byte(`[{"domain":"api.internal","ip":"10.0.0.1","enabled":true},{"domain":"api.internal","ip":"10.0.0.2","enabled":true}]`))
+	if err != nil || len(decoded) != 2 {
+		t.Fatalf("HostList_AddAddress decode test failed: %v", err)
+	}
+}
+
+func TestHostList_Resolve(t *testing.T) {
+	data := "10.2.0.1 preview.internal\n10.2.0.5 *.preview.internal\n10.2.0.6 *.b.preview.internal\n" +
+		"10.2.0.7 a.preview.internal\nfd00::7 a.preview.internal\n# 10.2.0.8 *.off.preview.internal\n"
+	hostFile, err := NewHostFileWithOptions([]byte(data), ParseOptions{Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"preview.internal":         "[10.2.0.1]",
+		"x.preview.internal":       "[10.2.0.5]",
+		"X.B.preview.internal.":    "[10.2.0.6]",
+		"b.preview.internal":       "[10.2.0.5]",
+		"a.preview.internal":       "[10.2.0.7 fd00::7]",
+		"x.off.preview.internal":   "[10.2.0.5]",
+		"x.preview.internal.other": "[]",
+	} {
+		if got := fmt.Sprint(hostFile.Hosts.Resolve(name)); got != expected {
+			t.Fatalf("HostList_Resolve %s test failed: %s", name, got)
+		}
+	}
+
+	expected := "10.2.0.1 preview.internal\n# etcdhosts: wildcard 10.2.0.5 *.preview.internal\n" +
+		"# etcdhosts: wildcard 10.2.0.6 *.b.preview.internal\n10.2.0.7 a.preview.internal\n" +
+		"# 10.2.0.8 *.off.preview.internal\nfd00::7 a.preview.internal\n"
+	formatted := hostFile.Format("linux")
+	if string(formatted) != expected {
+		t.Fatalf("HostList_Resolve format test failed: %q", formatted)
+	}
+	parsed, err := NewHostFile(formatted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(Diff(hostFile, parsed)) != 0 {
+		t.Fatal("HostList_Resolve round trip test failed")
+	}
+	if _, err = NewHostname("*.", "1.1.1.1", true); err == nil || ValidateDomain("*.preview.internal", DomainRFC1123) != nil {
+		t.Fatal("HostList_Resolve validation test failed")
+	}
+}
+
+func TestResolver(t *testing.T) {
+	hostFile, err := NewHostFile([]byte("10.0.0.1 web.internal www.internal\nfd00::1 web.internal\n" +
+		"# 10.0.0.2 off.internal\n10.0.0.3 *.preview.internal\n::ffff:10.0.0.1 mapped.internal\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := NewResolver(hostFile.Hosts)
+	if got := fmt.Sprint(resolver.Resolve("WEB.internal.")); got != "[10.0.0.1 fd00::1]" || got != fmt.Sprint(hostFile.Hosts.Resolve("web.internal")) {
+		t.Fatalf("Resolver resolve test failed: %s", got)
+	}
+	if resolver.Resolve("off.internal") != nil || fmt.Sprint(resolver.Resolve("a.b.preview.internal")) != "[10.0.0.3]" {
+		t.Fatal("Resolver wildcard test failed")
+	}
+	names := resolver.LookupAddr(net.ParseIP("10.0.0.1"))
+	if fmt.Sprint(names) != "[web.internal www.internal mapped.internal]" || fmt.Sprint(hostFile.Hosts.LookupAddr(net.ParseIP("10.0.0.1"))) != fmt.Sprint(names) {
+		t.Fatalf("Resolver lookup test failed: %v", names)
+	}
+
+	if err = resolver.Enable("off.internal"); err != nil {
+		t.Fatal(err)
+	}
+	_ = resolver.Add(MustHostname("web.internal", "10.0.0.9", true))
+	resolver.RemoveDomainV("web.internal", 6)
+	if fmt.Sprint(resolver.Resolve("web.internal")) != "[10.0.0.9]" || fmt.Sprint(resolver.Resolve("off.internal")) != "[10.0.0.2]" {
+		t.Fatal("Resolver mutation test failed")
+	}
+	if fmt.Sprint(resolver.LookupAddr(net.ParseIP("10.0.0.1"))) != "[www.internal mapped.internal]" || len(hostFile.Hosts.FilterByDomain("web.internal")) != 2 {
+		t.Fatal("Resolver reverse mutation test failed")
+	}
+
+	// the incremental updates keep the list order of HostList
+	hostFile, err = NewHostFile([]byte("10.0.0.1 web.internal www.internal\nfd00::1 web.internal\n" +
+		"10.0.0.3 *.preview.internal\n::ffff:10.0.0.1 mapped.internal\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := hostFile.Hosts
+	resolver.SetHosts(hosts)
+	for _, hostname := range []*Hostname{
+		MustHostname("www.internal", "10.0.0.3", true),
+		MustHostname("api.internal", "10.0.0.3", true),
+		MustHostname("web.internal", "10.0.0.4", true),
+	} {
+		_ = hosts.Add(hostname)
+		_ = resolver.Add(hostname)
+	}
+	_ = hosts.AddAddress(MustHostname("api.internal", "10.0.0.1", true))
+	_ = resolver.AddAddress(MustHostname("api.internal", "10.0.0.1", true))
+	hosts.RemoveDomain("mapped.internal")
+	resolver.RemoveDomain("mapped.internal")
+	var got, expected []string
+	for _, hostname := range resolver.Hosts() {
+		got = append(got, hostname.Format())
+	}
+	for _, hostname := range hosts {
+		expected = append(expected, hostname.Format())
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("Resolver order test failed: %v", got)
+	}
+	if fmt.Sprint(resolver.LookupAddr(net.ParseIP("10.0.0.3"))) != "[www.internal api.internal]" ||
+		fmt.Sprint(resolver.LookupAddr(net.ParseIP("10.0.0.3"))) != fmt.Sprint(hosts.LookupAddr(net.ParseIP("10.0.0.3"))) {
+		t.Fatalf("Resolver order lookup test failed: %v", resolver.LookupAddr(net.ParseIP("10.0.0.3")))
+	}
+	if fmt.Sprint(resolver.LookupAddr(net.ParseIP("10.0.0.1"))) != "[api.internal]" {
+		t.Fatalf("Resolver order lookup test failed: %v", resolver.LookupAddr(net.ParseIP("10.0.0.1")))
+	}
+}
+
+// benchmarkHosts generates a hosts file of n entries, two domains per line
+// like an ad-blocking list.
+func benchmarkHosts(n int) []byte {
+	var b strings.Builder
+	for i := 0; i < n; i += 2 {
+		fmt.Fprintf(&b, "10.%d.%d.%d host%d.example.com host%d.example.net\n", i>>16&0xff, i>>8&0xff, i&0xff, i, i+1)
+	}
+	return []byte(b.String())
+}
+
+func benchmarkParse(b *testing.B, n int, opts ParseOptions) {
+	data := benchmarkHosts(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewHostFileWithOptions(data, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkFormat(b *testing.B, n int, opts ParseOptions) {
+	hostFile, err := NewHostFileWithOptions(benchmarkHosts(n), opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// a changed entry makes preserve mode rewrite its line
+	_ = hostFile.Hosts.Disable("host0.example.com")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hostFile.Format("linux")
+	}
+}
+
+func BenchmarkNewHostFile_10k(b *testing.B) {
+	benchmarkParse(b, 10000, ParseOptions{})
+}
+
+func BenchmarkNewHostFile_100k(b *testing.B) {
+	benchmarkParse(b, 100000, ParseOptions{})
+}
+
+func BenchmarkNewHostFile_200k(b *testing.B) {
+	benchmarkParse(b, 200000, ParseOptions{})
+}
+
+func BenchmarkNewHostFile_Preserve200k(b *testing.B) {
+	benchmarkParse(b, 200000, ParseOptions{Preserve: true})
+}
+
+func BenchmarkFormat_10k(b *testing.B) {
+	benchmarkFormat(b, 10000, ParseOptions{})
+}
+
+func BenchmarkFormat_100k(b *testing.B) {
+	benchmarkFormat(b, 100000, ParseOptions{})
+}
+
+func BenchmarkFormat_200k(b *testing.B) {
+	benchmarkFormat(b, 200000, ParseOptions{})
+}
+
+func BenchmarkFormat_Preserve200k(b *testing.B) {
+	benchmarkFormat(b, 200000, ParseOptions{Preserve: true})
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestParseHostFile(t *testing.T) {
+	data := "# etcdhosts: rollback of revision 3\n# office\n1.1.1.1 baidu.com # owner: ops\n\n# 2.2.2.2 google.com\n"
+	for _, opts := range []ParseOptions{{}, {Preserve: true}} {
+		expected, err := NewHostFileWithOptions([]byte(data), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostFile, err := ParseHostFile(strings.NewReader(data), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hostFile.GetData() != nil || hostFile.RollbackOf() != 3 || string(hostFile.Format("linux")) != string(expected.Format("linux")) {
+			t.Fatalf("ParseHostFile test failed: %q", hostFile.Format("linux"))
+		}
+
+		_ = hostFile.Hosts.Add(MustHostname("bing.com", "3.3.3.3", true))
+		var out strings.Builder
+		n, err := hostFile.WriteTo(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != string(hostFile.Format(runtime.GOOS)) || n != int64(out.Len()) {
+			t.Fatalf("ParseHostFile WriteTo test failed: %d %q", n, out.String())
+		}
+	}
+
+	if _, err := ParseHostFile(failingReader{}, ParseOptions{}); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Fatalf("ParseHostFile read error test failed: %v", err)
+	}
+	var parseErr *ParseError
+	if _, err := ParseHostFile(strings.NewReader("1.1.1 baidu.com"), ParseOptions{Strict: true}); !errors.As(err, &parseErr) {
+		t.Fatalf("ParseHostFile strict test failed: %v", err)
+	}
+
+	doc := struct {
+		Hosts *HostFile `json:"hosts"`
+	}{}
+	if err := json.Unmarshal([]byte(`{"hosts": "1.1.1.1 baidu.com\n"}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Hosts.Hosts) != 1 || string(bs) != `{"hosts":"1.1.1.1 baidu.com\n"}` {
+		t.Fatalf("ParseHostFile text marshal test failed: %s", bs)
+	}
+}
+
+// newTestClient creates a client of endpoint which is closed at the end of
+// the test.
+func newTestClient(t *testing.T, endpoint, key string, opts ...ClientOption) *HostsClient {
+	opts = append([]ClientOption{WithRequestTimeout(5 * time.Second)}, opts...)
+	cli, err := NewClientWithOptions([]string{endpoint}, key, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cli.Close() })
+	return cli
+}
+
+// numberedHosts returns a HostFile with the entries host0 to host<n-1>, their
+// addresses are numbered from offset.
+func numberedHosts(n, offset int) *HostFile {
+	hostFile := &HostFile{Hosts: HostList{}}
+	for i := 0; i < n; i++ {
+		ip := fmt.Sprintf("10.%d.%d.%d", (offset+i)>>16&0xff, (offset+i)>>8&0xff, (offset+i)&0xff)
+		_ = hostFile.Hosts.Add(MustHostname(fmt.Sprintf("host%d.internal", i), ip, true))
+	}
+	return hostFile
+}
+
+func TestHostsClient_PutEntriesAtomic(t *testing.T) {
+	// the default --max-txn-ops of 128 is too small for the writes below
+	endpoint := etcdtest.Start(t, nil)
+	cli := newTestClient(t, endpoint, "/entries", WithStorageLayout(LayoutEntries))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// every event shows one of the written sets, never a part of one
+	var sets []string
+	for _, hostFile := range []*HostFile{numberedHosts(200, 0), numberedHosts(300, 1000)} {
+		sets = append(sets, string(hostFile.Hosts.Format("linux")))
+	}
+	events := cli.WatchHosts(ctx)
+	if event := nextEvent(t, events); !event.Deleted {
+		t.Fatal("PutEntriesAtomic initial event test failed")
+	}
+	watched := make(chan error, 1)
+	go func() {
+		for event := range events {
+			if event.Err != nil {
+				watched <- event.Err
+				return
+			}
+			switch string(event.HostFile.Hosts.Format("linux")) {
+			case sets[0]:
+			case sets[1]:
+				watched <- nil
+				return
+			default:
+				watched <- fmt.Errorf("partial event at revision %d: %d entries", event.Revision, len(event.HostFile.Hosts))
+				return
+			}
+		}
+		watched <- errors.New("watch closed")
+	}()
+
+	revision, err := cli.PutHostsIfRevisionContext(ctx, numberedHosts(200, 0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vh, err := cli.GetVHostsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vh.Revision != revision || string(vh.HostFile.Hosts.Format("linux")) != sets[0] {
+		t.Fatalf("PutEntriesAtomic test failed: revision %d of %d, %d entries", vh.Revision, revision, len(vh.HostFile.Hosts))
+	}
+
+	revision, err = cli.PutHostsIfRevisionContext(ctx, numberedHosts(300, 1000), revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vh, err = cli.GetVHostsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vh.Revision != revision || string(vh.HostFile.Hosts.Format("linux")) != sets[1] {
+		t.Fatalf("PutEntriesAtomic generation test failed: revision %d of %d, %d entries", vh.Revision, revision, len(vh.HostFile.Hosts))
+	}
+	if err = <-watched; err != nil {
+		t.Fatalf("PutEntriesAtomic watch test failed: %v", err)
+	}
+
+	// a stale revision must not write any of the entries, and the staged
+	// generation is removed again
+	_, err = cli.PutHostsIfRevisionContext(ctx, numberedHosts(150, 2000), revision-1)
+	var conflict *RevisionConflictError
+	if !errors.As(err, &conflict) || conflict.Current == nil || conflict.Current.Revision != revision {
+		t.Fatalf("PutEntriesAtomic conflict test failed: %v", err)
+	}
+	if vh, err = cli.GetVHostsContext(ctx); err != nil || vh.Revision != revision {
+		t.Fatalf("PutEntriesAtomic conflict write test failed: %v", err)
+	}
+	kvs, _, err := cli.getHostKeys(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := cli.newEntrySet(kvs)
+	if len(kvs) != len(set.entries)+2 {
+		t.Fatalf("PutEntriesAtomic cleanup test failed: %d keys for %d entries", len(kvs), len(set.entries))
+	}
+
+	// single entries are written to the current generation
+	if _, err = cli.PutEntry(ctx, MustHostname("host0.internal", "10.9.9.9", true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.DeleteEntry(ctx, "host1.internal", 4); err != nil {
+		t.Fatal(err)
+	}
+	hostFile, err := cli.GetHostsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatted := string(hostFile.Hosts.Format("linux"))
+	if len(hostFile.Hosts) != 299 || !strings.Contains(formatted, "10.9.9.9 host0.internal") || strings.Contains(formatted, " host1.internal") {
+		t.Fatalf("PutEntriesAtomic PutEntry test failed: %d entries", len(hostFile.Hosts))
+	}
+}
+
+func TestHostsClient_PutEntriesTooManyOps(t *testing.T) {
+	endpoint := etcdtest.Start(t, func(cfg *embed.Config) { cfg.MaxTxnOps = 64 })
+	cli := newTestClient(t, endpoint, "/entries", WithStorageLayout(LayoutEntries))
+	ctx := context.Background()
+
+	_, err := cli.PutHostsIfRevisionContext(ctx, numberedHosts(200, 0), 0)
+	if !errors.Is(err, ErrTooManyEntryChanges) {
+		t.Fatalf("PutEntriesTooManyOps test failed: %v", err)
+	}
+	kvs, _, err := cli.getHostKeys(ctx, 0)
+	if err != nil || len(kvs) != 0 {
+		t.Fatalf("PutEntriesTooManyOps partial write test failed: %d keys, %v", len(kvs), err)
+	}
+}
+
+func TestHostsClient_PutEntriesConcurrent(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	cli := newTestClient(t, endpoint, "/entries", WithStorageLayout(LayoutEntries))
+	other := newTestClient(t, endpoint, "/entries", WithStorageLayout(LayoutEntries))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// single entry writes of another client race with the unguarded writes
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; ctx.Err() == nil; i++ {
+			var err error
+			if i%2 == 0 {
+				_, err = other.PutEntry(ctx, MustHostname("racer.internal", "10.9.0.1", true))
+			} else {
+				// the entry may already be replaced by a write of cli
+				if _, err = other.DeleteEntry(ctx, "racer.internal", 4); errors.Is(err, ErrHostnameNotFound) {
+					err = nil
+				}
+			}
+			if err != nil && ctx.Err() == nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for i := 1; i <= 10; i++ {
+		hostFile := numberedHosts(i%5+1, i)
+		revision, err := cli.putEntries(ctx, hostFile, "", -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the write replaced every entry, including one written concurrently
+		written, err := cli.GetHostsWithRevisionContext(ctx, revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(written.Hosts.Format("linux")) != string(hostFile.Hosts.Format("linux")) {
+			t.Fatalf("PutEntriesConcurrent test failed at revision %d: %q", revision, written.Hosts.Format("linux"))
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// entryRevisions returns the ModRevision of every entry key of cli.
+func entryRevisions(t *testing.T, cli *HostsClient) map[string]int64 {
+	t.Helper()
+	kvs, _, err := cli.getHostKeys(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revisions := make(map[string]int64)
+	for _, kv := range cli.newEntrySet(kvs).entries {
+		revisions[string(kv.Key)] = kv.ModRevision
+	}
+	return revisions
+}
+
+func TestHostsClient_PutEntry(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli := newTestClient(t, endpoint, "/entry", WithStorageLayout(LayoutEntries))
+	if err := cli.PutHosts(numberedHosts(3, 0)); err != nil {
+		t.Fatal(err)
+	}
+	events := cli.WatchHosts(ctx)
+	nextEvent(t, events)
+
+	// only the key of the entry is written, the other entries keep their
+	// ModRevision
+	check := func(name string, revision int64, before map[string]int64, key string, change EntryChange) {
+		t.Helper()
+		after := entryRevisions(t, cli)
+		for k, modRevision := range before {
+			if k != key && after[k] != modRevision {
+				t.Fatalf("%s test failed: %s was written", name, k)
+			}
+		}
+		if change.Hostname != nil && after[key] != revision {
+			t.Fatalf("%s test failed: %s was not written", name, key)
+		}
+		if _, ok := after[key]; change.Hostname == nil && ok {
+			t.Fatalf("%s test failed: %s was not deleted", name, key)
+		}
+
+		event := nextEvent(t, events)
+		if event.Err != nil || event.Revision != revision || len(event.Changes) != 1 {
+			t.Fatalf("%s watch test failed: %+v", name, event)
+		}
+		got := event.Changes[0]
+		if got.Domain != change.Domain || got.Version != change.Version || (got.Hostname == nil) != (change.Hostname == nil) ||
+			(got.Hostname != nil && got.Hostname.Format() != change.Hostname.Format()) {
+			t.Fatalf("%s watch change test failed: %+v", name, got)
+		}
+	}
+
+	before := entryRevisions(t, cli)
+	hostname := MustHostname("host1.internal", "10.5.0.1", true)
+	revision, err := cli.PutEntry(ctx, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("PutEntry", revision, before, cli.entryKey("", "host1.internal", "4"), EntryChange{Domain: "host1.internal", Version: 4, Hostname: hostname})
+
+	before = entryRevisions(t, cli)
+	hostname = MustHostname("new.internal", "fd00::1", true)
+	revision, err = cli.PutEntry(ctx, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("PutEntry IPv6", revision, before, cli.entryKey("", "new.internal", "6"), EntryChange{Domain: "new.internal", Version: 6, Hostname: hostname})
+
+	before = entryRevisions(t, cli)
+	revision, err = cli.DeleteEntry(ctx, "host0.internal", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("DeleteEntry", revision, before, cli.entryKey("", "host0.internal", "4"), EntryChange{Domain: "host0.internal", Version: 4})
+
+	// domains are case-insensitive, the entries are found in any case
+	before = entryRevisions(t, cli)
+	hostname = MustHostname("HOST2.Internal", "10.5.0.2", true)
+	revision, err = cli.PutEntry(ctx, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("PutEntry case", revision, before, cli.entryKey("", "host2.internal", "4"), EntryChange{Domain: "host2.internal", Version: 4, Hostname: hostname})
+
+	before = entryRevisions(t, cli)
+	revision, err = cli.DeleteEntry(ctx, "Host1.INTERNAL", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("DeleteEntry case", revision, before, cli.entryKey("", "host1.internal", "4"), EntryChange{Domain: "host1.internal", Version: 4})
+
+	hostFile, err := cli.GetHostsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "10.5.0.2 HOST2.Internal\nfd00::1 new.internal\n"
+	if string(hostFile.Hosts.Format("linux")) != expected {
+		t.Fatalf("PutEntry hosts test failed: %q", hostFile.Hosts.Format("linux"))
+	}
+
+	// deleting a missing entry writes nothing
+	vh, err := cli.GetVHostsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.DeleteEntry(ctx, "host1.internal", 4); !errors.Is(err, ErrHostnameNotFound) {
+		t.Fatalf("DeleteEntry not found test failed: %v", err)
+	}
+	if _, err = cli.DeleteEntry(ctx, "new.internal", 4); !errors.Is(err, ErrHostnameNotFound) {
+		t.Fatalf("DeleteEntry IP version not found test failed: %v", err)
+	}
+	if current, err := cli.GetVHostsContext(ctx); err != nil || current.Revision != vh.Revision {
+		t.Fatalf("DeleteEntry not found write test failed: %v", err)
+	}
+
+	if _, err = cli.DeleteEntry(ctx, "host2.internal", 5); err != ErrInvalidVersionArg {
+		t.Fatalf("DeleteEntry version test failed: %v", err)
+	}
+	blob := newTestClient(t, endpoint, "/entry-blob")
+	if _, err = blob.PutEntry(ctx, MustHostname("a.internal", "10.0.0.1", true)); err == nil {
+		t.Fatal("PutEntry layout test failed")
+	}
+	if _, err = blob.DeleteEntry(ctx, "a.internal", 4); err == nil {
+		t.Fatal("DeleteEntry layout test failed")
+	}
+}
+
+func TestHostsClient_EntriesMultiAddress(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	multi := newTestClient(t, endpoint, "/entries", WithStorageLayout(LayoutEntries), WithMultiAddress())
+	single := newTestClient(t, endpoint, "/entries", WithStorageLayout(LayoutEntries))
+
+	hostFile, err := NewHostFileWithOptions([]byte("1.1.1.1 a.internal\n2.2.2.2 a.internal\n"), ParseOptions{MultiAddress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = multi.PutHostsContext(ctx, hostFile); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := multi.GetHostsContext(ctx); err != nil || len(got.Hosts) != 2 {
+		t.Fatalf("EntriesMultiAddress test failed: %v", err)
+	}
+	// without WithMultiAddress a later address replaces the earlier one
+	if got, err := single.GetHostsContext(ctx); err != nil || len(got.Hosts) != 1 {
+		t.Fatalf("EntriesMultiAddress single test failed: %v", err)
+	}
+	if event := nextEvent(t, single.WatchHosts(ctx)); event.Err != nil || len(event.HostFile.Hosts) != 1 {
+		t.Fatalf("EntriesMultiAddress watch test failed: %+v", event)
+	}
+	if event := nextEvent(t, multi.WatchHosts(ctx)); event.Err != nil || len(event.HostFile.Hosts) != 2 {
+		t.Fatalf("EntriesMultiAddress multi watch test failed: %+v", event)
+	}
+}
+
+func TestHostsClient_KeyRange(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx := context.Background()
+	blob := newTestClient(t, endpoint, "/hosts")
+	neighbour := newTestClient(t, endpoint, "/hosts-prod", WithStorageLayout(LayoutEntries))
+
+	if err := neighbour.PutHostsContext(ctx, numberedHosts(3, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blob.PutHostsIfRevisionContext(ctx, numberedHosts(2, 0), 0); err != nil {
+		t.Fatal(err)
+	}
+	entries := newTestClient(t, endpoint, "/hosts", WithStorageLayout(LayoutEntries))
+	revision, err := entries.MigrateToEntries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = neighbour.PutHostsContext(ctx, numberedHosts(4, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	hostFile, err := entries.GetHostsWithRevisionContext(ctx, revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "10.0.0.0 host0.internal\n10.0.0.1 host1.internal\n"
+	if string(hostFile.Hosts.Format("linux")) != expected {
+		t.Fatalf("KeyRange test failed: %q", hostFile.Hosts.Format("linux"))
+	}
+	if hostFile, err = neighbour.GetHostsContext(ctx); err != nil || len(hostFile.Hosts) != 4 {
+		t.Fatalf("KeyRange neighbour test failed: %v", err)
+	}
+}
+
+// nextEvent returns the next event of a WatchHosts channel.
+func nextEvent(t *testing.T, events <-chan HostsEvent) HostsEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("watch channel closed")
+		}
+		return event
+	case <-time.After(10 * time.Second):
+		t.Fatal("no watch event")
+	}
+	return HostsEvent{}
+}
+
+func TestHostsClient_WatchKeyRange(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli := newTestClient(t, endpoint, "/hosts")
+
+	events := cli.WatchHosts(ctx)
+	if event := nextEvent(t, events); event.Err != nil || !event.Deleted {
+		t.Fatalf("WatchKeyRange initial event test failed: %+v", event)
+	}
+	for _, key := range []string{"/hosts-prod", "/hosts.bak", "/hostsz"} {
+		if err := newTestClient(t, endpoint, key).PutHostsContext(ctx, numberedHosts(1, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revision, err := cli.PutHostsIfRevisionContext(ctx, numberedHosts(2, 0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Err != nil || event.Revision != revision || len(event.HostFile.Hosts) != 2 {
+		t.Fatalf("WatchKeyRange test failed: %+v", event)
+	}
+}
+
+// ephemeralOf returns the entries of hostFile that are marked as Ephemeral.
+func ephemeralOf(hostFile *HostFile) []string {
+	var domains []string
+	for _, hostname := range hostFile.Hosts {
+		if hostname.Ephemeral {
+			domains = append(domains, hostname.Domain)
+		}
+	}
+	return domains
+}
+
+func TestHostsClient_RegisterHost(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, layout := range []StorageLayout{LayoutBlob, LayoutEntries} {
+		cli := newTestClient(t, endpoint, fmt.Sprintf("/ephemeral-%d", layout), WithStorageLayout(layout))
+		if err := cli.PutHosts(numberedHosts(1, 0)); err != nil {
+			t.Fatal(err)
+		}
+		events := cli.WatchHosts(ctx)
+		if event := nextEvent(t, events); event.Err != nil || len(ephemeralOf(event.HostFile)) != 0 {
+			t.Fatalf("RegisterHost layout %d initial event test failed: %+v", layout, event)
+		}
+
+		reg, err := cli.RegisterHost(ctx, MustHostname("worker.internal", "10.0.4.17", true), 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := nextEvent(t, events)
+		if event.Err != nil || fmt.Sprint(ephemeralOf(event.HostFile)) != "[worker.internal]" || len(event.HostFile.Hosts) != 2 {
+			t.Fatalf("RegisterHost layout %d watch test failed: %+v", layout, event)
+		}
+		hostFile, err := cli.GetHosts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(ephemeralOf(hostFile)) != "[worker.internal]" || len(hostFile.Hosts) != 2 {
+			t.Fatalf("RegisterHost layout %d get test failed: %q", layout, hostFile.Hosts.Format("linux"))
+		}
+		// pushing the merged hosts keeps the registration out of the static
+		// hosts
+		if err = cli.PutHosts(hostFile); err != nil {
+			t.Fatal(err)
+		}
+		nextEvent(t, events)
+
+		if err = reg.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if event = nextEvent(t, events); event.Err != nil || len(ephemeralOf(event.HostFile)) != 0 || len(event.HostFile.Hosts) != 1 {
+			t.Fatalf("RegisterHost layout %d close watch test failed: %+v", layout, event)
+		}
+		if hostFile, err = cli.GetHosts(); err != nil || len(hostFile.Hosts) != 1 {
+			t.Fatalf("RegisterHost layout %d close test failed: %v", layout, err)
+		}
+		select {
+		case <-reg.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("RegisterHost layout %d close test failed: keepalive still running", layout)
+		}
+	}
+}
+
+func TestHostsClient_RegisterHostShared(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli := newTestClient(t, endpoint, "/ephemeral", WithMultiAddress())
+	single := newTestClient(t, endpoint, "/ephemeral")
+	if err := cli.PutHosts(numberedHosts(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	events := cli.WatchHosts(ctx)
+	nextEvent(t, events)
+
+	// two owners register the same domain, both addresses are served
+	first, err := cli.RegisterHost(ctx, MustHostname("worker.internal", "10.0.4.17", true), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, events)
+	second, err := single.RegisterHost(ctx, MustHostname("worker.internal", "10.0.4.18", true), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = second.Close(context.Background()) }()
+	if event := nextEvent(t, events); event.Err != nil || fmt.Sprint(ephemeralOf(event.HostFile)) != "[worker.internal worker.internal]" {
+		t.Fatalf("RegisterHostShared watch test failed: %+v", event)
+	}
+	hostFile, err := cli.GetHosts()
+	if err != nil || fmt.Sprint(ephemeralOf(hostFile)) != "[worker.internal worker.internal]" {
+		t.Fatalf("RegisterHostShared get test failed: %v", err)
+	}
+	if hostFile, err = single.GetHosts(); err != nil || fmt.Sprint(ephemeralOf(hostFile)) != "[worker.internal]" {
+		t.Fatalf("RegisterHostShared single get test failed: %v", err)
+	}
+
+	// the domain stays as long as one of the owners is alive
+	if err = first.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	event := nextEvent(t, events)
+	if event.Err != nil || fmt.Sprint(ephemeralOf(event.HostFile)) != "[worker.internal]" {
+		t.Fatalf("RegisterHostShared close watch test failed: %+v", event)
+	}
+	if !strings.Contains(string(event.HostFile.Hosts.Format("linux")), "10.0.4.18 worker.internal") {
+		t.Fatalf("RegisterHostShared close test failed: %q", event.HostFile.Hosts.Format("linux"))
+	}
+}
+
+func TestHostsClient_RegisterHostExpiry(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli := newTestClient(t, endpoint, "/ephemeral")
+	if err := cli.PutHosts(numberedHosts(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	events := cli.WatchHosts(ctx)
+	nextEvent(t, events)
+
+	reg, err := cli.RegisterHost(ctx, MustHostname("worker.internal", "10.0.4.17", true), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Err != nil || fmt.Sprint(ephemeralOf(event.HostFile)) != "[worker.internal]" {
+		t.Fatalf("RegisterHostExpiry watch test failed: %+v", event)
+	}
+	// stopping the keepalive without revoking the lease is what happens when
+	// the owner dies, etcd removes the entry once the lease expires
+	reg.cancel()
+	select {
+	case <-reg.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("RegisterHostExpiry test failed: keepalive still running")
+	}
+	if event := nextEvent(t, events); event.Err != nil || len(ephemeralOf(event.HostFile)) != 0 || len(event.HostFile.Hosts) != 1 {
+		t.Fatalf("RegisterHostExpiry expiry watch test failed: %+v", event)
+	}
+	hostFile, err := cli.GetHosts()
+	if err != nil || len(hostFile.Hosts) != 1 || hostFile.Hosts.ContainsDomain("worker.internal") {
+		t.Fatalf("RegisterHostExpiry expiry test failed: %v", err)
+	}
+	ephemeral, err := cli.GetEphemeralHosts(ctx)
+	if err != nil || len(ephemeral) != 0 {
+		t.Fatalf("RegisterHostExpiry GetEphemeralHosts test failed: %v", err)
+	}
+}
+
+func TestHostsClient_GetHostsCacheWrites(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	path := filepath.Join(t.TempDir(), "hosts.json")
+	cli := newTestClient(t, endpoint, "/cache", WithCache(path))
+	if err := cli.PutHosts(numberedHosts(2, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := func() os.FileInfo {
+		t.Helper()
+		if _, err := cli.GetHosts(); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+	// the cache file is replaced by a rename, so an unchanged file is the
+	// same file
+	first := stat()
+	if !os.SameFile(first, stat()) {
+		t.Fatal("GetHostsCacheWrites test failed: unchanged hosts rewrote the cache")
+	}
+	if err := cli.PutHosts(numberedHosts(3, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(first, stat()) {
+		t.Fatal("GetHostsCacheWrites test failed: changed hosts were not cached")
+	}
+	vh, err := cli.LoadCache()
+	if err != nil || len(vh.HostFile.Hosts) != 3 {
+		t.Fatalf("GetHostsCacheWrites load test failed: %v", err)
+	}
+
+	// a done context of the caller is reported instead of using the cache
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = cli.GetHostsContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetHostsCacheWrites canceled test failed: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	if _, err = cli.GetHostsContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetHostsCacheWrites deadline test failed: %v", err)
+	}
+}
+
+func TestHostsClient_GetHostsHistoryWithOptions(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx := context.Background()
+	noise := newTestClient(t, endpoint, "/noise")
+
+	for _, layout := range []StorageLayout{LayoutBlob, LayoutEntries} {
+		cli := newTestClient(t, endpoint, fmt.Sprintf("/history-%d", layout), WithStorageLayout(layout))
+		// writes to other keys between the versions must not show up in the
+		// history walk
+		var revisions []int64
+		var modRevision int64
+		for i := 1; i <= 5; i++ {
+			if err := noise.PutHosts(numberedHosts(i, 100)); err != nil {
+				t.Fatal(err)
+			}
+			revision, err := cli.PutHostsIfRevisionContext(ctx, numberedHosts(i, 0), modRevision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			revisions = append(revisions, revision)
+			modRevision = revision
+		}
+
+		history, err := cli.GetHostsHistoryWithOptions(ctx, HistoryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history.Versions) != 5 || history.Truncated {
+			t.Fatalf("GetHostsHistoryWithOptions layout %d test failed: %d versions", layout, len(history.Versions))
+		}
+		for i, vh := range history.Versions {
+			if vh.Version != int64(5-i) || vh.Revision != revisions[4-i] || len(vh.HostFile.Hosts) != 5-i {
+				t.Fatalf("GetHostsHistoryWithOptions layout %d version test failed: %+v", layout, vh)
+			}
+		}
+
+		// page through the history two versions at a time
+		var paged []int64
+		opts := HistoryOptions{Limit: 2}
+		for {
+			page, err := cli.GetHostsHistoryWithOptions(ctx, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Versions) == 0 {
+				break
+			}
+			if len(page.Versions) > 2 {
+				t.Fatalf("GetHostsHistoryWithOptions limit test failed: %d versions", len(page.Versions))
+			}
+			for _, vh := range page.Versions {
+				paged = append(paged, vh.Revision)
+			}
+			opts.Before = page.Versions[len(page.Versions)-1].Revision
+		}
+		if fmt.Sprint(paged) != fmt.Sprint([]int64{revisions[4], revisions[3], revisions[2], revisions[1], revisions[0]}) {
+			t.Fatalf("GetHostsHistoryWithOptions paging test failed: %v of %v", paged, revisions)
+		}
+
+		history, err = cli.GetHostsHistoryWithOptions(ctx, HistoryOptions{Since: revisions[2]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history.Versions) != 3 || history.Versions[2].Revision != revisions[2] {
+			t.Fatalf("GetHostsHistoryWithOptions since test failed: %d versions", len(history.Versions))
+		}
+
+		// the versions before the compaction are gone, the walk reports where
+		// it was cut off
+		if _, err = cli.cli.Compact(ctx, revisions[2]); err != nil {
+			t.Fatal(err)
+		}
+		history, err = cli.GetHostsHistoryWithOptions(ctx, HistoryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history.Versions) != 3 || !history.Truncated || history.CompactRevision != revisions[2]-1 {
+			t.Fatalf("GetHostsHistoryWithOptions compaction test failed: %d versions, %+v", len(history.Versions), history)
+		}
+		versions, err := cli.GetHostsHistory()
+		if err != nil || len(versions) != 3 {
+			t.Fatalf("GetHostsHistory compaction test failed: %v", err)
+		}
+	}
+}
+
+func TestHostsClient_GetHostsHistoryCompactedAtCreate(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx := context.Background()
+
+	for _, layout := range []StorageLayout{LayoutBlob, LayoutEntries} {
+		cli := newTestClient(t, endpoint, fmt.Sprintf("/history-create-%d", layout), WithStorageLayout(layout))
+		created, err := cli.PutHostsIfRevisionContext(ctx, numberedHosts(1, 0), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// nothing older than the first version was lost, the history is
+		// complete although the revision before it is compacted
+		if _, err = cli.cli.Compact(ctx, created); err != nil {
+			t.Fatal(err)
+		}
+		history, err := cli.GetHostsHistoryWithOptions(ctx, HistoryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history.Versions) != 1 || history.Truncated || history.Versions[0].Revision != created {
+			t.Fatalf("GetHostsHistoryCompactedAtCreate layout %d test failed: %d versions, %+v", layout, len(history.Versions), history)
+		}
+
+		if _, err = cli.PutHostsIfRevisionContext(ctx, numberedHosts(2, 0), created); err != nil {
+			t.Fatal(err)
+		}
+		history, err = cli.GetHostsHistoryWithOptions(ctx, HistoryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history.Versions) != 2 || history.Truncated || history.Versions[1].Version != 1 {
+			t.Fatalf("GetHostsHistoryCompactedAtCreate layout %d second version test failed: %d versions, %+v", layout, len(history.Versions), history)
+		}
+	}
+}
+
+func TestHostsClient_Update(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx := context.Background()
+
+	for _, layout := range []StorageLayout{LayoutBlob, LayoutEntries} {
+		key := fmt.Sprintf("/update-%d", layout)
+		cli := newTestClient(t, endpoint, key, WithStorageLayout(layout))
+		other := newTestClient(t, endpoint, key, WithStorageLayout(layout))
+		if err := cli.PutHosts(numberedHosts(1, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		// a concurrent write makes the first attempt conflict, the retry
+		// starts from the hosts carried by the conflict
+		var seen []int
+		vh, err := cli.Update(ctx, func(hostFile *HostFile) error {
+			seen = append(seen, len(hostFile.Hosts))
+			if len(seen) == 1 {
+				if err := other.PutHosts(numberedHosts(2, 0)); err != nil {
+					return err
+				}
+			}
+			_ = hostFile.Hosts.Add(MustHostname("new.internal", "10.1.0.1", true))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(seen) != "[1 2]" {
+			t.Fatalf("Update layout %d retry test failed: fn saw %v entries", layout, seen)
+		}
+		current, err := cli.GetVHostsContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vh.Revision != current.Revision || vh.Version != current.Version || len(current.HostFile.Hosts) != 3 ||
+			!current.HostFile.Hosts.ContainsDomain("host1.internal") {
+			t.Fatalf("Update layout %d test failed: %+v", layout, current)
+		}
+
+		// a concurrent delete makes the retry start from empty hosts
+		seen = nil
+		vh, err = cli.Update(ctx, func(hostFile *HostFile) error {
+			seen = append(seen, len(hostFile.Hosts))
+			if len(seen) == 1 {
+				if _, err := cli.cli.Delete(ctx, key); err != nil {
+					return err
+				}
+				if _, err := cli.cli.Delete(ctx, key+"/", clientv3.WithPrefix()); err != nil {
+					return err
+				}
+			}
+			_ = hostFile.Hosts.Add(MustHostname("new.internal", "10.1.0.2", true))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(seen) != "[3 0]" || vh.Version != 1 {
+			t.Fatalf("Update layout %d delete test failed: fn saw %v entries, version %d", layout, seen, vh.Version)
+		}
+		hostFile, err := cli.GetHostsContext(ctx)
+		if err != nil || string(hostFile.Hosts.Format("linux")) != "10.1.0.2 new.internal\n" {
+			t.Fatalf("Update layout %d delete test failed: %v", layout, err)
+		}
+
+		// errors of fn abort the update without writing
+		fnErr := errors.New("rejected")
+		if _, err = cli.Update(ctx, func(*HostFile) error { return fnErr }); err != fnErr {
+			t.Fatalf("Update layout %d fn error test failed: %v", layout, err)
+		}
+	}
+}
+
+// pushBeforeTxn runs push once before the next transaction, which puts a
+// concurrent write between the reads and the write of a client.
+type pushBeforeTxn struct {
+	clientv3.KV
+	push func()
+}
+
+func (kv *pushBeforeTxn) Txn(ctx context.Context) clientv3.Txn {
+	if kv.push != nil {
+		kv.push()
+		kv.push = nil
+	}
+	return kv.KV.Txn(ctx)
+}
+
+func TestHostsClient_Rollback(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	ctx := context.Background()
+
+	for _, layout := range []StorageLayout{LayoutBlob, LayoutEntries} {
+		cli := newTestClient(t, endpoint, fmt.Sprintf("/rollback-%d", layout), WithStorageLayout(layout))
+		first, err := cli.PutHostsIfRevisionContext(ctx, numberedHosts(1, 0), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cli.PutHosts(numberedHosts(2, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		revision, err := cli.Rollback(ctx, first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vh, err := cli.GetVHostsContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vh.Revision != revision || vh.Version != 3 ||
+			string(vh.HostFile.Hosts.Format("linux")) != string(numberedHosts(1, 0).Hosts.Format("linux")) {
+			t.Fatalf("Rollback layout %d test failed: %+v", layout, vh)
+		}
+		resp, err := cli.cli.Get(ctx, cli.hostKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if marker := fmt.Sprintf(rollbackMarker+"\n", first); !strings.HasPrefix(string(resp.Kvs[0].Value), marker) ||
+			vh.HostFile.RollbackOf() != first {
+			t.Fatalf("Rollback layout %d marker test failed: %q", layout, resp.Kvs[0].Value)
+		}
+
+		// the marker is not carried over to the next version
+		if err = cli.PutHosts(vh.HostFile); err != nil {
+			t.Fatal(err)
+		}
+		if hostFile, err := cli.GetHostsContext(ctx); err != nil || hostFile.RollbackOf() != 0 {
+			t.Fatalf("Rollback layout %d next version test failed: %v", layout, err)
+		}
+	}
+
+	// a push between reading the current revision and writing the rollback
+	// is not overwritten
+	cli := newTestClient(t, endpoint, "/rollback-conflict")
+	other := newTestClient(t, endpoint, "/rollback-conflict")
+	first, err := cli.PutHostsIfRevisionContext(ctx, numberedHosts(1, 0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.PutHosts(numberedHosts(2, 0)); err != nil {
+		t.Fatal(err)
+	}
+	kv := cli.cli.KV
+	cli.cli.KV = &pushBeforeTxn{KV: kv, push: func() {
+		if err := other.PutHosts(numberedHosts(3, 0)); err != nil {
+			t.Error(err)
+		}
+	}}
+	_, err = cli.Rollback(ctx, first)
+	cli.cli.KV = kv
+	var conflict *RevisionConflictError
+	if !errors.As(err, &conflict) || conflict.Current == nil || len(conflict.Current.HostFile.Hosts) != 3 {
+		t.Fatalf("Rollback conflict test failed: %v", err)
+	}
+	hostFile, err := cli.GetHostsContext(ctx)
+	if err != nil || len(hostFile.Hosts) != 3 || hostFile.RollbackOf() != 0 {
+		t.Fatalf("Rollback conflict write test failed: %v", err)
+	}
+
+	// a compacted revision can no longer be rolled back to
+	vh, err := cli.GetVHostsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.cli.Compact(ctx, vh.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.Rollback(ctx, first); !errors.Is(err, rpctypes.ErrCompacted) {
+		t.Fatalf("Rollback compacted test failed: %v", err)
+	}
+	if current, err := cli.GetVHostsContext(ctx); err != nil || current.Revision != vh.Revision {
+		t.Fatalf("Rollback compacted write test failed: %v", err)
+	}
+}
+
+func TestHostsClient_Context(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	cli := newTestClient(t, endpoint, "/context")
+	revision, err := cli.PutHostsIfRevisionContext(context.Background(), numberedHosts(1, 0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, call := range map[string]func(context.Context) error{
+		"PutHostsContext": func(ctx context.Context) error {
+			return cli.PutHostsContext(ctx, numberedHosts(2, 0))
+		},
+		"PutHostsIfRevisionContext": func(ctx context.Context) error {
+			_, err := cli.PutHostsIfRevisionContext(ctx, numberedHosts(2, 0), revision)
+			return err
+		},
+		"GetVHostsContext": func(ctx context.Context) error {
+			_, err := cli.GetVHostsContext(ctx)
+			return err
+		},
+		"GetHostsContext": func(ctx context.Context) error {
+			_, err := cli.GetHostsContext(ctx)
+			return err
+		},
+		"GetHostsWithRevisionContext": func(ctx context.Context) error {
+			_, err := cli.GetHostsWithRevisionContext(ctx, revision)
+			return err
+		},
+		"GetHostsHistoryContext": func(ctx context.Context) error {
+			_, err := cli.GetHostsHistoryContext(ctx)
+			return err
+		},
+		"Update": func(ctx context.Context) error {
+			_, err := cli.Update(ctx, func(*HostFile) error { return nil })
+			return err
+		},
+		"Rollback": func(ctx context.Context) error {
+			_, err := cli.Rollback(ctx, revision)
+			return err
+		},
+	} {
+		if err := call(canceled); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Context %s test failed: %v", name, err)
+		}
+	}
+	if vh, err := cli.GetVHosts(); err != nil || vh.Revision != revision {
+		t.Fatalf("Context write test failed: %v", err)
+	}
+
+	// Update stops retrying once ctx is done while it backs off after a
+	// conflict
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	_, err = cli.Update(ctx, func(hostFile *HostFile) error {
+		calls++
+		if err := cli.PutHostsContext(context.Background(), numberedHosts(calls, 0)); err != nil {
+			return err
+		}
+		time.AfterFunc(updateInitialBackoff/2, cancel)
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("Context Update retry test failed after %d calls: %v", calls, err)
+	}
+}
+
+func TestHostsClient_WatchHostsResync(t *testing.T) {
+	cfg := etcdtest.Config(t)
+	e := etcdtest.Run(t, cfg)
+	endpoint := cfg.ACUrls[0].String()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli := newTestClient(t, endpoint, "/watch")
+	revision, err := cli.PutHostsIfRevisionContext(ctx, numberedHosts(1, 0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := cli.WatchHosts(ctx)
+	if event := nextEvent(t, events); event.Err != nil || event.Revision < revision || len(event.HostFile.Hosts) != 1 {
+		t.Fatalf("WatchHostsResync initial event test failed: %+v", event)
+	}
+	if err = cli.PutHosts(numberedHosts(2, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Err != nil || len(event.HostFile.Hosts) != 2 {
+		t.Fatalf("WatchHostsResync event test failed: %+v", event)
+	}
+
+	// resuming from a compacted revision requires a resync
+	vh, err := cli.GetVHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.cli.Compact(ctx, vh.Revision); err != nil {
+		t.Fatal(err)
+	}
+	state := &hostsState{entries: map[string][]*Hostname{}, ephemeral: map[string]*Hostname{}}
+	if next, ok := cli.watchFrom(ctx, make(chan HostsEvent, 1), state, revision); next != 0 || !ok {
+		t.Fatalf("WatchHostsResync compacted watch test failed: %d %v", next, ok)
+	}
+
+	// the watch survives a restart of etcd, changes and a compaction made
+	// while it was disconnected are picked up by the resync
+	e.Close()
+	etcdtest.Run(t, cfg)
+	writer := newTestClient(t, endpoint, "/watch")
+	for i := 3; i <= 4; i++ {
+		if err = writer.PutHosts(numberedHosts(i, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if vh, err = writer.GetVHosts(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.cli.Compact(ctx, vh.Revision); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		event := nextEvent(t, events)
+		if event.Err != nil {
+			continue
+		}
+		if event.Revision > vh.Revision || (event.Revision == vh.Revision && len(event.HostFile.Hosts) != 4) {
+			t.Fatalf("WatchHostsResync restart test failed: %+v", event)
+		}
+		if event.Revision == vh.Revision {
+			break
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// etcdhosts-syncd watches the hosts stored in etcd and keeps a managed block
+// of a local hosts file in sync with them.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	etcdhosts "github.com/mritd/etcdhosts-client"
+)
+
+func main() {
+	endpoints := flag.String("endpoints", "http://127.0.0.1:2379", "comma separated etcd endpoints")
+	hostKey := flag.String("key", "/etcdhosts", "etcd key of the hosts")
+	ca := flag.String("ca", "", "etcd ca file or base64 data")
+	cert := flag.String("cert", "", "etcd client cert file or base64 data")
+	certKey := flag.String("cert-key", "", "etcd client key file or base64 data")
+	username := flag.String("user", "", "etcd username")
+	password := flag.String("password", "", "etcd password")
+	entries := flag.Bool("entries", false, "read hosts stored with the per-entry layout")
+	target := flag.String("target", "/etc/hosts", "hosts file to update")
+	backup := flag.String("backup", "", "backup file (default target + \".etcdhosts.bak\")")
+	cache := flag.String("cache", "", "local cache file used when etcd is unreachable")
+	flag.Parse()
+
+	var opts []etcdhosts.ClientOption
+	if *cert != "" || *certKey != "" {
+		opts = append(opts, etcdhosts.WithTLS(*ca, *cert, *certKey))
+	} else if *ca != "" {
+		opts = append(opts, etcdhosts.WithCA(*ca))
+	}
+	if *username != "" {
+		opts = append(opts, etcdhosts.WithAuth(*username, *password))
+	}
+	if *entries {
+		opts = append(opts, etcdhosts.WithStorageLayout(etcdhosts.LayoutEntries))
+	}
+	if *cache != "" {
+		opts = append(opts, etcdhosts.WithCache(*cache))
+	}
+
+	cli, err := etcdhosts.NewClientWithOptions(strings.Split(*endpoints, ","), *hostKey, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	syncer := etcdhosts.NewSyncer(cli, *target)
+	if *backup != "" {
+		syncer.Backup = *backup
+	}
+	syncer.OnError = func(err error) { log.Println(err) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	// apply the cached hosts first so the node can boot during an etcd outage
+	if *cache != "" {
+		if hostFile, err := cli.GetHosts(); err == nil {
+			if err = syncer.Apply(hostFile, 0); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	log.Printf("syncing %s from %s", *target, *hostKey)
+	if err = syncer.Run(ctx); err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+}
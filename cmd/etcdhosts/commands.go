@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	etcdhosts "github.com/mritd/etcdhosts-client"
+)
+
+// command runs a single subcommand against the hosts client.
+type command struct {
+	cli     *etcdhosts.HostsClient
+	json    bool
+	timeout time.Duration
+	out     io.Writer
+}
+
+func (c *command) run(name string, args []string) error {
+	switch name {
+	case "get":
+		return c.get(args)
+	case "put":
+		return c.put(args)
+	case "add":
+		return c.add(args)
+	case "rm":
+		return c.rm(args)
+	case "enable":
+		return c.toggle(args, true)
+	case "disable":
+		return c.toggle(args, false)
+	case "history":
+		return c.history(args)
+	case "show":
+		return c.show(args)
+	case "diff":
+		return c.diff(args)
+	case "rollback":
+		return c.rollback(args)
+	case "watch":
+		return c.watch(args)
+	}
+	return fmt.Errorf("unknown command %q", name)
+}
+
+func (c *command) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+func (c *command) get(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: get")
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	hostFile, err := c.cli.GetHostsContext(ctx)
+	if err != nil {
+		return err
+	}
+	return c.printHosts(hostFile)
+}
+
+func (c *command) put(args []string) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	file := fs.String("f", "", "hosts file to push, \"-\" reads stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" || fs.NArg() > 0 {
+		return errors.New("usage: put -f <file>")
+	}
+
+	in := os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		in = f
+	}
+	hostFile, err := etcdhosts.ParseHostFile(in, etcdhosts.ParseOptions{Preserve: true})
+	if err != nil {
+		return err
+	}
+	for _, warning := range hostFile.Warnings() {
+		fmt.Fprintf(os.Stderr, "etcdhosts: %s: %v\n", *file, warning)
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	vh, err := c.cli.Update(ctx, func(current *etcdhosts.HostFile) error {
+		*current = *hostFile
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.printRevision(vh.Revision)
+}
+
+func (c *command) add(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: add <ip> <domain...>")
+	}
+	var hostnames []*etcdhosts.Hostname
+	for _, domain := range args[1:] {
+		hostname, err := etcdhosts.NewHostname(domain, args[0], true)
+		if err != nil {
+			return err
+		}
+		hostnames = append(hostnames, hostname)
+	}
+	return c.update(func(hostFile *etcdhosts.HostFile) error {
+		for _, hostname := range hostnames {
+			// replace the other entry of the domain and IP version, adding an
+			// existing entry again only enables it
+			if !hostFile.Hosts.Contains(hostname) {
+				version := 4
+				if hostname.IPv6 {
+					version = 6
+				}
+				hostFile.Hosts.RemoveDomainV(hostname.Domain, version)
+			}
+			err := hostFile.Hosts.Add(hostname)
+			if err != nil && !errors.Is(err, etcdhosts.ErrDuplicateHostname) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *command) rm(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: rm <domain...>")
+	}
+	return c.update(func(hostFile *etcdhosts.HostFile) error {
+		for _, domain := range args {
+			removed := hostFile.Hosts.RemoveDomainV(domain, 4) + hostFile.Hosts.RemoveDomainV(domain, 6)
+			if removed == 0 {
+				return fmt.Errorf("%w: %s", etcdhosts.ErrHostnameNotFound, domain)
+			}
+		}
+		return nil
+	})
+}
+
+func (c *command) toggle(args []string, enabled bool) error {
+	if len(args) < 1 {
+		if enabled {
+			return errors.New("usage: enable <domain...>")
+		}
+		return errors.New("usage: disable <domain...>")
+	}
+	return c.update(func(hostFile *etcdhosts.HostFile) error {
+		for _, domain := range args {
+			found := false
+			for _, version := range []int{4, 6} {
+				var err error
+				if enabled {
+					err = hostFile.Hosts.EnableV(domain, version)
+				} else {
+					err = hostFile.Hosts.DisableV(domain, version)
+				}
+				found = found || err == nil
+			}
+			if !found {
+				return fmt.Errorf("%w: %s", etcdhosts.ErrHostnameNotFound, domain)
+			}
+		}
+		return nil
+	})
+}
+
+// update applies fn to the current hosts and pushes them, retrying on
+// concurrent changes.
+func (c *command) update(fn func(*etcdhosts.HostFile) error) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	vh, err := c.cli.Update(ctx, fn)
+	if err != nil {
+		return err
+	}
+	return c.printRevision(vh.Revision)
+}
+
+type historyEntry struct {
+	Version    int64              `json:"version"`
+	Revision   int64              `json:"revision"`
+	RollbackOf int64              `json:"rollback_of,omitempty"`
+	Hosts      etcdhosts.HostList `json:"hosts"`
+}
+
+func (c *command) history(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	limit := fs.Int("limit", 0, "maximum number of versions, 0 means all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	history, err := c.cli.GetHostsHistoryWithOptions(ctx, etcdhosts.HistoryOptions{Limit: *limit})
+	if err != nil {
+		return err
+	}
+
+	entries := make([]historyEntry, 0, len(history.Versions))
+	for _, vh := range history.Versions {
+		entries = append(entries, historyEntry{
+			Version:    vh.Version,
+			Revision:   vh.Revision,
+			RollbackOf: vh.HostFile.RollbackOf(),
+			Hosts:      vh.HostFile.Hosts,
+		})
+	}
+	if c.json {
+		return c.printJSON(entries)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tREVISION\tENTRIES\tROLLBACK OF")
+	for _, e := range entries {
+		rollbackOf := "-"
+		if e.RollbackOf > 0 {
+			rollbackOf = strconv.FormatInt(e.RollbackOf, 10)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\n", e.Version, e.Revision, len(e.Hosts), rollbackOf)
+	}
+	if history.Truncated {
+		fmt.Fprintf(w, "(older versions compacted at revision %d)\n", history.CompactRevision)
+	}
+	return w.Flush()
+}
+
+func (c *command) show(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ContinueOnError)
+	rev := fs.Int64("rev", 0, "revision of the hosts")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *rev < 1 || fs.NArg() > 0 {
+		return errors.New("usage: show -rev <N>")
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	hostFile, err := c.cli.GetHostsWithRevisionContext(ctx, *rev)
+	if err != nil {
+		return err
+	}
+	return c.printHosts(hostFile)
+}
+
+type changeEntry struct {
+	Type    string              `json:"type"`
+	Domain  string              `json:"domain"`
+	Version int                 `json:"version"`
+	Old     *etcdhosts.Hostname `json:"old,omitempty"`
+	New     *etcdhosts.Hostname `json:"new,omitempty"`
+}
+
+func (c *command) diff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	unified := fs.Bool("u", false, "print a unified diff of the hosts files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errors.New("usage: diff [-u] <rev> [rev]")
+	}
+	revs := []int64{-1, -1}
+	for i, arg := range fs.Args() {
+		rev, err := parseRevision(arg)
+		if err != nil {
+			return err
+		}
+		revs[i] = rev
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	a, err := c.cli.GetHostsWithRevisionContext(ctx, revs[0])
+	if err != nil {
+		return err
+	}
+	b, err := c.cli.GetHostsWithRevisionContext(ctx, revs[1])
+	if err != nil {
+		return err
+	}
+
+	if *unified && !c.json {
+		_, err = io.WriteString(c.out, etcdhosts.UnifiedDiff(revisionLabel(revs[0]), a, revisionLabel(revs[1]), b))
+		return err
+	}
+
+	changes := etcdhosts.Diff(a, b)
+	if c.json {
+		entries := make([]changeEntry, 0, len(changes))
+		for _, change := range changes {
+			entries = append(entries, changeEntry{
+				Type:    change.Type.String(),
+				Domain:  change.Domain,
+				Version: change.Version,
+				Old:     change.Old,
+				New:     change.New,
+			})
+		}
+		return c.printJSON(entries)
+	}
+	for _, change := range changes {
+		fmt.Fprintln(c.out, change)
+	}
+	return nil
+}
+
+func (c *command) rollback(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: rollback <rev>")
+	}
+	rev, err := parseRevision(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	revision, err := c.cli.Rollback(ctx, rev)
+	if err != nil {
+		return err
+	}
+	return c.printRevision(revision)
+}
+
+type watchEntry struct {
+	Revision int64              `json:"revision"`
+	Deleted  bool               `json:"deleted,omitempty"`
+	Hosts    etcdhosts.HostList `json:"hosts,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+func (c *command) watch(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: watch")
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	for event := range c.cli.WatchHosts(ctx) {
+		if c.json {
+			entry := watchEntry{Revision: event.Revision, Deleted: event.Deleted}
+			if event.Err != nil {
+				entry.Error = event.Err.Error()
+			} else {
+				entry.Hosts = event.HostFile.Hosts
+			}
+			// one object per line, so the output can be streamed
+			bs, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(c.out, string(bs))
+			continue
+		}
+
+		if event.Err != nil {
+			fmt.Fprintln(os.Stderr, "etcdhosts:", event.Err)
+			continue
+		}
+		fmt.Fprintf(c.out, "# revision %d\n", event.Revision)
+		if event.Deleted {
+			fmt.Fprintln(c.out, "# hosts deleted")
+		}
+		if _, err := c.out.Write(event.HostFile.Format(runtime.GOOS)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *command) printHosts(hostFile *etcdhosts.HostFile) error {
+	if c.json {
+		return c.printJSON(hostFile.Hosts)
+	}
+	_, err := c.out.Write(hostFile.Format(runtime.GOOS))
+	return err
+}
+
+func (c *command) printRevision(revision int64) error {
+	if c.json {
+		return c.printJSON(map[string]int64{"revision": revision})
+	}
+	_, err := fmt.Fprintf(c.out, "revision %d\n", revision)
+	return err
+}
+
+func (c *command) printJSON(v interface{}) error {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, string(bs))
+	return err
+}
+
+func parseRevision(s string) (int64, error) {
+	rev, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || rev < 1 {
+		return 0, fmt.Errorf("invalid revision %q", s)
+	}
+	return rev, nil
+}
+
+func revisionLabel(rev int64) string {
+	if rev < 0 {
+		return "current"
+	}
+	return "revision " + strconv.FormatInt(rev, 10)
+}
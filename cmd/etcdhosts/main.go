@@ -0,0 +1,247 @@
+// etcdhosts is a command line tool to manage the hosts stored in etcd.
+//
+// Usage:
+//
+//	etcdhosts [flags] <command> [args]
+//
+// The connection is configured by flags, ETCDHOSTS_* environment variables or
+// a JSON config file, in this order of precedence.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	etcdhosts "github.com/mritd/etcdhosts-client"
+)
+
+const usage = `Usage: etcdhosts [flags] <command> [args]
+
+Commands:
+  get                      print the current hosts
+  put -f <file>            replace the hosts with the content of file ("-" for stdin)
+  add <ip> <domain...>     add or replace entries
+  rm <domain...>           remove the entries of domains
+  enable <domain...>       enable the entries of domains
+  disable <domain...>      disable the entries of domains
+  history [-limit N]       list the versions of the hosts
+  show -rev <N>            print the hosts at revision N
+  diff [-u] <rev> [rev]    show the changes between two revisions (default: current)
+  rollback <rev>           write the hosts of revision rev back as a new version
+  watch                    print every change of the hosts
+
+Flags:
+`
+
+// config holds the connection settings, it can be loaded from a JSON file.
+type config struct {
+	Endpoints string   `json:"endpoints"`
+	Key       string   `json:"key"`
+	CA        string   `json:"ca"`
+	Cert      string   `json:"cert"`
+	CertKey   string   `json:"cert_key"`
+	User      string   `json:"user"`
+	Password  string   `json:"password"`
+	Entries   bool     `json:"entries"`
+	Timeout   duration `json:"timeout"`
+}
+
+// duration is a time.Duration written as a string like "5s" in the config
+// file.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func main() {
+	err := run(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "etcdhosts:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	cfg, jsonOutput, args, err := parseArgs(args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+
+	cli, err := newClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = cli.Close() }()
+
+	c := &command{cli: cli, json: jsonOutput, timeout: time.Duration(cfg.Timeout), out: os.Stdout}
+	return c.run(args[0], args[1:])
+}
+
+// parseArgs parses the global flags and returns the connection settings
+// resolved from the config file, the environment and the flags together with
+// the command and its arguments.
+func parseArgs(args []string) (config, bool, []string, error) {
+	fs := flag.NewFlagSet("etcdhosts", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", "", "JSON config file (default $ETCDHOSTS_CONFIG or ~/.etcdhosts.json)")
+	flags := config{}
+	fs.StringVar(&flags.Endpoints, "endpoints", "", "comma separated etcd endpoints (env ETCDHOSTS_ENDPOINTS)")
+	fs.StringVar(&flags.Key, "key", "", "etcd key of the hosts (env ETCDHOSTS_KEY)")
+	fs.StringVar(&flags.CA, "ca", "", "etcd ca file or base64 data (env ETCDHOSTS_CA)")
+	fs.StringVar(&flags.Cert, "cert", "", "etcd client cert file or base64 data (env ETCDHOSTS_CERT)")
+	fs.StringVar(&flags.CertKey, "cert-key", "", "etcd client key file or base64 data (env ETCDHOSTS_CERT_KEY)")
+	fs.StringVar(&flags.User, "user", "", "etcd username (env ETCDHOSTS_USER)")
+	fs.StringVar(&flags.Password, "password", "", "etcd password (env ETCDHOSTS_PASSWORD)")
+	fs.BoolVar(&flags.Entries, "entries", false, "use the per-entry storage layout (env ETCDHOSTS_ENTRIES)")
+	timeout := fs.Duration("timeout", 0, "request timeout (default 5s)")
+	jsonOutput := fs.Bool("json", false, "print JSON instead of text")
+	if err := fs.Parse(args); err != nil {
+		return config{}, false, nil, err
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return config{}, false, nil, errors.New("missing command")
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return config{}, false, nil, err
+	}
+	applyEnv(&cfg)
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "endpoints":
+			cfg.Endpoints = flags.Endpoints
+		case "key":
+			cfg.Key = flags.Key
+		case "ca":
+			cfg.CA = flags.CA
+		case "cert":
+			cfg.Cert = flags.Cert
+		case "cert-key":
+			cfg.CertKey = flags.CertKey
+		case "user":
+			cfg.User = flags.User
+		case "password":
+			cfg.Password = flags.Password
+		case "entries":
+			cfg.Entries = flags.Entries
+		case "timeout":
+			cfg.Timeout = duration(*timeout)
+		}
+	})
+	return cfg, *jsonOutput, fs.Args(), nil
+}
+
+// loadConfig reads the config file, a missing default config file is not an
+// error.
+func loadConfig(path string) (config, error) {
+	cfg := config{
+		Endpoints: "http://127.0.0.1:2379",
+		Key:       "/etcdhosts",
+		Timeout:   duration(5 * time.Second),
+	}
+	explicit := path != ""
+	if path == "" {
+		path = os.Getenv("ETCDHOSTS_CONFIG")
+		explicit = path != ""
+	}
+	if path == "" {
+		path = "~/.etcdhosts.json"
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return cfg, nil
+		}
+		return cfg, fmt.Errorf("read config %s failed: %w", path, err)
+	}
+	err = json.Unmarshal(bs, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("parse config %s failed: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func applyEnv(cfg *config) {
+	env := map[string]*string{
+		"ETCDHOSTS_ENDPOINTS": &cfg.Endpoints,
+		"ETCDHOSTS_KEY":       &cfg.Key,
+		"ETCDHOSTS_CA":        &cfg.CA,
+		"ETCDHOSTS_CERT":      &cfg.Cert,
+		"ETCDHOSTS_CERT_KEY":  &cfg.CertKey,
+		"ETCDHOSTS_USER":      &cfg.User,
+		"ETCDHOSTS_PASSWORD":  &cfg.Password,
+	}
+	for name, value := range env {
+		if v, ok := os.LookupEnv(name); ok {
+			*value = v
+		}
+	}
+	if v, ok := os.LookupEnv("ETCDHOSTS_ENTRIES"); ok {
+		cfg.Entries = v == "1" || strings.EqualFold(v, "true")
+	}
+}
+
+func newClient(cfg config) (*etcdhosts.HostsClient, error) {
+	opts := []etcdhosts.ClientOption{etcdhosts.WithRequestTimeout(time.Duration(cfg.Timeout))}
+	if cfg.Cert != "" || cfg.CertKey != "" {
+		opts = append(opts, etcdhosts.WithTLS(cfg.CA, cfg.Cert, cfg.CertKey))
+	} else if cfg.CA != "" {
+		opts = append(opts, etcdhosts.WithCA(cfg.CA))
+	}
+	if cfg.User != "" {
+		opts = append(opts, etcdhosts.WithAuth(cfg.User, cfg.Password))
+	}
+	if cfg.Entries {
+		opts = append(opts, etcdhosts.WithStorageLayout(etcdhosts.LayoutEntries))
+	}
+	return etcdhosts.NewClientWithOptions(strings.Split(cfg.Endpoints, ","), cfg.Key, opts...)
+}
+
+// signalContext returns a context which is canceled on SIGINT or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mritd/etcdhosts-client/internal/etcdtest"
+)
+
+// setenv sets the environment variable name for the rest of the test.
+func setenv(t *testing.T, name, value string) {
+	old, ok := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(name, old)
+		} else {
+			_ = os.Unsetenv(name)
+		}
+	})
+}
+
+func TestParseArgs(t *testing.T) {
+	for _, name := range []string{"ETCDHOSTS_ENDPOINTS", "ETCDHOSTS_KEY", "ETCDHOSTS_USER", "ETCDHOSTS_ENTRIES"} {
+		setenv(t, name, "")
+		_ = os.Unsetenv(name)
+	}
+	config := filepath.Join(t.TempDir(), "etcdhosts.json")
+	data := `{"endpoints": "http://file:2379", "key": "/file", "user": "file", "timeout": "9s"}`
+	if err := ioutil.WriteFile(config, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "ETCDHOSTS_CONFIG", config)
+	setenv(t, "ETCDHOSTS_KEY", "/env")
+	setenv(t, "ETCDHOSTS_USER", "env")
+
+	cfg, jsonOutput, args, err := parseArgs([]string{"-json", "-user", "flag", "get"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Endpoints != "http://file:2379" || time.Duration(cfg.Timeout) != 9*time.Second {
+		t.Fatalf("config file values not applied: %+v", cfg)
+	}
+	if cfg.Key != "/env" || cfg.User != "flag" || !jsonOutput || fmt.Sprint(args) != "[get]" {
+		t.Fatalf("unexpected precedence: %+v %v %v", cfg, jsonOutput, args)
+	}
+
+	// flags set to the zero value still win over the environment
+	setenv(t, "ETCDHOSTS_ENTRIES", "true")
+	cfg, _, _, err = parseArgs([]string{"-entries=false", "get"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Entries {
+		t.Fatal("-entries=false did not override ETCDHOSTS_ENTRIES")
+	}
+
+	if _, _, _, err = parseArgs([]string{"-config", filepath.Join(t.TempDir(), "missing.json"), "get"}); err == nil {
+		t.Fatal("a missing explicit config file must fail")
+	}
+}
+
+func TestCommandAdd(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	for _, entries := range []bool{false, true} {
+		cli, err := newClient(config{
+			Endpoints: endpoint,
+			Key:       fmt.Sprintf("/add-%v", entries),
+			Entries:   entries,
+			Timeout:   duration(5 * time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &strings.Builder{}
+		c := &command{cli: cli, timeout: 5 * time.Second, out: out}
+
+		for _, args := range [][]string{
+			{"10.0.0.1", "foo.internal"},
+			{"fd00::1", "foo.internal"},
+			{"10.0.0.2", "foo.internal", "bar.internal"},
+			{"10.0.0.2", "foo.internal"},
+		} {
+			if err = c.run("add", args); err != nil {
+				t.Fatalf("add %v: %v", args, err)
+			}
+		}
+		if err = c.run("disable", []string{"bar.internal"}); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.run("add", []string{"10.0.0.2", "bar.internal"}); err != nil {
+			t.Fatal(err)
+		}
+
+		hostFile, err := cli.GetHostsContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "10.0.0.2 bar.internal foo.internal\nfd00::1 foo.internal\n"
+		if got := string(hostFile.Hosts.Format("linux")); got != expected {
+			t.Fatalf("entries %v: unexpected hosts %q", entries, got)
+		}
+		_ = cli.Close()
+	}
+}
@@ -0,0 +1,514 @@
+package etcdhosts_client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// ChangeType classifies a Change between two HostFiles.
+type ChangeType int
+
+const (
+	ChangeAdded ChangeType = iota
+	ChangeRemoved
+	ChangeIPChanged
+	ChangeEnabled
+	ChangeDisabled
+	ChangeCommentChanged
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeIPChanged:
+		return "ip-changed"
+	case ChangeEnabled:
+		return "enabled"
+	case ChangeDisabled:
+		return "disabled"
+	case ChangeCommentChanged:
+		return "comment-changed"
+	}
+	return fmt.Sprintf("ChangeType(%d)", int(t))
+}
+
+// Change is a difference of a single domain and IP version between two
+// HostFiles. Old is nil for added entries and New is nil for removed ones. An
+// entry whose IP changed and which was toggled at the same time is reported
+// as ChangeIPChanged.
+type Change struct {
+	Type    ChangeType
+	Domain  string
+	Version int
+	Old     *Hostname
+	New     *Hostname
+}
+
+// String formats the Change for humans, e.g. "~ baidu.com: 1.1.1.1 -> 2.2.2.2".
+func (c Change) String() string {
+	switch c.Type {
+	case ChangeAdded:
+		return fmt.Sprintf("+ %s -> %s %s", c.Domain, c.New.IPString(), c.New.FormatEnabled())
+	case ChangeRemoved:
+		return fmt.Sprintf("- %s -> %s", c.Domain, c.Old.IPString())
+	case ChangeIPChanged:
+		return fmt.Sprintf("~ %s: %s -> %s %s", c.Domain, c.Old.IPString(), c.New.IPString(), c.New.FormatEnabled())
+	case ChangeCommentChanged:
+		return fmt.Sprintf("~ %s: comment %q -> %q", c.Domain, c.Old.FormatComment(), c.New.FormatComment())
+	}
+	return fmt.Sprintf("~ %s -> %s %s", c.Domain, c.New.IPString(), c.New.FormatEnabled())
+}
+
+// domainKey identifies an entry by domain and IP version, which are unique
+// within a HostList. Zone-scoped addresses are keyed by their zone as well,
+// so "fe80::1%lo0 localhost" doesn't replace "::1 localhost".
+type domainKey struct {
+	domain  string
+	version int
+	zone    string
+}
+
+func keyOf(hostname *Hostname) domainKey {
+	domain := strings.ToLower(hostname.Domain)
+	if hostname.IPv6 {
+		return domainKey{domain, 6, hostname.Zone}
+	}
+	return domainKey{domain, 4, ""}
+}
+
+// indexDomainV groups the Hosts of hostFile by domain and IP version, a key
+// has several Hostnames only for domains with several addresses.
+func indexDomainV(hostFile *HostFile) map[domainKey][]*Hostname {
+	m := make(map[domainKey][]*Hostname)
+	if hostFile == nil {
+		return m
+	}
+	for _, hostname := range hostFile.Hosts {
+		key := keyOf(hostname)
+		m[key] = append(m[key], hostname)
+	}
+	return m
+}
+
+// byAddress indexes hostnames of the same domain and IP version by address.
+func byAddress(hostnames []*Hostname) map[string]*Hostname {
+	m := make(map[string]*Hostname, len(hostnames))
+	for _, hostname := range hostnames {
+		m[hostname.IPString()] = hostname
+	}
+	return m
+}
+
+// Diff compares the Hosts of a and b by domain and IP version and returns the
+// changes needed to turn a into b, sorted by domain and IP version. Either
+// HostFile may be nil, which is treated as empty. Domains with several
+// addresses (see HostList.AddAddress) are compared address by address, so an
+// address change shows up as a removal and an addition.
+func Diff(a, b *HostFile) []Change {
+	before, after := indexDomainV(a), indexDomainV(b)
+
+	var changes []Change
+	for k, olds := range before {
+		news := after[k]
+		if len(olds) > 1 || len(news) > 1 {
+			changes = append(changes, diffAddresses(k, olds, news)...)
+			continue
+		}
+		old := olds[0]
+		if len(news) == 0 {
+			changes = append(changes, newChange(ChangeRemoved, k, old, nil))
+			continue
+		}
+		n := news[0]
+		if !old.EqualAddr(n) {
+			changes = append(changes, newChange(ChangeIPChanged, k, old, n))
+			continue
+		}
+		if change, ok := stateChange(k, old, n); ok {
+			changes = append(changes, change)
+		}
+	}
+	for k, news := range after {
+		if _, ok := before[k]; ok {
+			continue
+		}
+		for _, n := range news {
+			changes = append(changes, newChange(ChangeAdded, k, nil, n))
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if c := compareDomains(changes[i].Domain, changes[j].Domain); c != 0 {
+			return c < 0
+		}
+		if changes[i].Version != changes[j].Version {
+			return changes[i].Version < changes[j].Version
+		}
+		return changes[i].address() < changes[j].address()
+	})
+	return changes
+}
+
+// newChange creates a Change of k. The lowercase domain of k only serves
+// to match the entries, the Change reports the domain as written in n, or
+// in old for removals.
+func newChange(t ChangeType, k domainKey, old, n *Hostname) Change {
+	domain := k.domain
+	switch {
+	case n != nil:
+		domain = n.Domain
+	case old != nil:
+		domain = old.Domain
+	}
+	return Change{Type: t, Domain: domain, Version: k.version, Old: old, New: n}
+}
+
+// diffAddresses compares the address sets of a domain and IP version.
+func diffAddresses(k domainKey, olds, news []*Hostname) []Change {
+	var changes []Change
+	newByAddr, oldByAddr := byAddress(news), byAddress(olds)
+	for _, old := range olds {
+		n, ok := newByAddr[old.IPString()]
+		if !ok {
+			changes = append(changes, newChange(ChangeRemoved, k, old, nil))
+			continue
+		}
+		if change, ok := stateChange(k, old, n); ok {
+			changes = append(changes, change)
+		}
+	}
+	for _, n := range news {
+		if _, ok := oldByAddr[n.IPString()]; !ok {
+			changes = append(changes, newChange(ChangeAdded, k, nil, n))
+		}
+	}
+	return changes
+}
+
+// stateChange classifies the change of an entry whose address is unchanged,
+// it returns false if the entry is unchanged.
+func stateChange(k domainKey, old, n *Hostname) (Change, bool) {
+	change := newChange(0, k, old, n)
+	switch {
+	case old.Enabled != n.Enabled && n.Enabled:
+		change.Type = ChangeEnabled
+	case old.Enabled != n.Enabled:
+		change.Type = ChangeDisabled
+	case old.FormatComment() != n.FormatComment():
+		change.Type = ChangeCommentChanged
+	default:
+		return change, false
+	}
+	return change, true
+}
+
+// address returns the address the Change is about, used to order changes of
+// the same domain.
+func (c Change) address() string {
+	if c.New != nil {
+		return c.New.IPString()
+	}
+	return c.Old.IPString()
+}
+
+// DiffRevisions returns the changes between the hosts at revision r1 and the
+// hosts at revision r2, see Diff. A revision of -1 stands for the current
+// hosts.
+func (hc *HostsClient) DiffRevisions(ctx context.Context, r1, r2 int64) ([]Change, error) {
+	a, err := hc.GetHostsWithRevisionContext(ctx, r1)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hc.GetHostsWithRevisionContext(ctx, r2)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(a, b), nil
+}
+
+// diffContext is the number of unchanged lines around a hunk of UnifiedDiff.
+const diffContext = 3
+
+// UnifiedDiff renders the difference of the formatted HostFiles as a unified
+// diff, labelled with aLabel and bLabel. It returns an empty string if both
+// format to the same text.
+func UnifiedDiff(aLabel string, a *HostFile, bLabel string, b *HostFile) string {
+	var aText, bText []byte
+	if a != nil {
+		aText = a.Format(runtime.GOOS)
+	}
+	if b != nil {
+		bText = b.Format(runtime.GOOS)
+	}
+	return unifiedDiff(aLabel, splitLines(aText), bLabel, splitLines(bText))
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// diffMaxWork bounds the work of diffLines to about that many line
+// comparisons, edit scripts longer than the bound fall back to replacing
+// the remaining lines.
+const diffMaxWork = 1 << 26
+
+// diffLines computes a line based edit script from a to b with the linear
+// space variant of Myers' algorithm, so large hosts files do not need a
+// table of len(a)*len(b) entries. Deleted lines come before the inserted
+// lines of each change.
+func diffLines(a, b []string) []diffOp {
+	d := &differ{a: a, b: b, ops: make([]diffOp, 0, len(a)+len(b))}
+	d.maxCost = diffMaxWork / (len(a) + len(b) + 1)
+	if d.maxCost < 64 {
+		d.maxCost = 64
+	}
+	d.compare(0, len(a), 0, len(b))
+
+	// order the lines of each change run as deletions before insertions
+	ops := d.ops
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		end := start
+		for end < len(ops) && ops[end].kind != ' ' {
+			end++
+		}
+		sort.SliceStable(ops[start:end], func(i, j int) bool {
+			return ops[start+i].kind == '-' && ops[start+j].kind == '+'
+		})
+		start = end
+	}
+	return ops
+}
+
+type differ struct {
+	a, b    []string
+	ops     []diffOp
+	maxCost int
+}
+
+// compare appends the edit script from a[a0:a1] to b[b0:b1].
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		d.ops = append(d.ops, diffOp{' ', d.a[a0]})
+		a0++
+		b0++
+	}
+	suffix := 0
+	for a1-suffix > a0 && b1-suffix > b0 && d.a[a1-1-suffix] == d.b[b1-1-suffix] {
+		suffix++
+	}
+	a1, b1 = a1-suffix, b1-suffix
+
+	if a0 < a1 && b0 < b1 {
+		if x, y, ok := d.bisect(a0, a1, b0, b1); ok {
+			d.compare(a0, x, b0, y)
+			d.compare(x, a1, y, b1)
+		} else {
+			d.replace(a0, a1, b0, b1)
+		}
+	} else {
+		d.replace(a0, a1, b0, b1)
+	}
+	for _, line := range d.a[a1 : a1+suffix] {
+		d.ops = append(d.ops, diffOp{' ', line})
+	}
+}
+
+func (d *differ) replace(a0, a1, b0, b1 int) {
+	for _, line := range d.a[a0:a1] {
+		d.ops = append(d.ops, diffOp{'-', line})
+	}
+	for _, line := range d.b[b0:b1] {
+		d.ops = append(d.ops, diffOp{'+', line})
+	}
+}
+
+// bisect finds the middle snake of a[a0:a1] and b[b0:b1] by searching
+// forward from the start and backward from the end at the same time, and
+// returns the point where the paths meet to split the problem in two. It
+// fails when the paths do not meet within maxCost edits.
+func (d *differ) bisect(a0, a1, b0, b1 int) (int, int, bool) {
+	n, m := a1-a0, b1-b0
+	maxD := (n + m + 1) / 2
+	if maxD > d.maxCost {
+		maxD = d.maxCost
+	}
+	offset := maxD + 1
+	size := 2*maxD + 3
+	// vf[offset+k] is the furthest x reached on diagonal k going forward,
+	// vb the same going backward from the end
+	vf, vb := make([]int, size), make([]int, size)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[offset+1], vb[offset+1] = 0, 0
+	delta := n - m
+	// with an odd delta the forward path is the first to overlap
+	front := delta%2 != 0
+
+	// the diagonals whose paths left the edit graph
+	kfStart, kfEnd, kbStart, kbEnd := 0, 0, 0, 0
+	for step := 0; step < maxD; step++ {
+		for k := -step + kfStart; k <= step-kfEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -step || (k != step && vf[i-1] < vf[i+1]) {
+				x = vf[i+1]
+			} else {
+				x = vf[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.a[a0+x] == d.b[b0+y] {
+				x++
+				y++
+			}
+			vf[i] = x
+			switch {
+			case x > n:
+				kfEnd += 2
+			case y > m:
+				kfStart += 2
+			case front:
+				j := offset + delta - k
+				if j >= 0 && j < size && vb[j] != -1 && x >= n-vb[j] {
+					return d.split(a0, a1, b0, b1, x, y)
+				}
+			}
+		}
+		for k := -step + kbStart; k <= step-kbEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -step || (k != step && vb[i-1] < vb[i+1]) {
+				x = vb[i+1]
+			} else {
+				x = vb[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.a[a1-1-x] == d.b[b1-1-y] {
+				x++
+				y++
+			}
+			vb[i] = x
+			switch {
+			case x > n:
+				kbEnd += 2
+			case y > m:
+				kbStart += 2
+			case !front:
+				j := offset + delta - k
+				if j >= 0 && j < size && vf[j] != -1 && vf[j] >= n-x {
+					fx := vf[j]
+					return d.split(a0, a1, b0, b1, fx, fx-(j-offset))
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// split converts the relative split point x, y into positions of a and b,
+// refusing points which would not make the problem smaller.
+func (d *differ) split(a0, a1, b0, b1, x, y int) (int, int, bool) {
+	if (x == 0 && y == 0) || (a0+x == a1 && b0+y == b1) {
+		return 0, 0, false
+	}
+	return a0 + x, b0 + y, true
+}
+
+func unifiedDiff(aLabel string, a []string, bLabel string, b []string) string {
+	ops := diffLines(a, b)
+	out := bytes.Buffer{}
+
+	// counted is the number of ops before line aNext of a and bNext of b
+	counted, aNext, bNext := 0, 1, 1
+	for start := 0; start < len(ops); {
+		// find the next change
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		if out.Len() == 0 {
+			out.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", aLabel, bLabel))
+		}
+
+		// extend the hunk until there are more than 2*diffContext unchanged
+		// lines in a row
+		first := start - diffContext
+		if first < 0 {
+			first = 0
+		}
+		end := start
+		for unchanged := 0; end < len(ops) && unchanged <= 2*diffContext; end++ {
+			if ops[end].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		// trim trailing context to diffContext lines
+		last := end
+		for last > start && ops[last-1].kind == ' ' {
+			last--
+		}
+		last += diffContext
+		if last > len(ops) {
+			last = len(ops)
+		}
+
+		// line numbers of the hunk start in a and b, counted on from the
+		// previous hunk
+		for _, op := range ops[counted:first] {
+			if op.kind != '+' {
+				aNext++
+			}
+			if op.kind != '-' {
+				bNext++
+			}
+		}
+		counted = first
+		aLine, bLine := aNext, bNext
+		aCount, bCount := 0, 0
+		for _, op := range ops[first:last] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		if aCount == 0 {
+			aLine--
+		}
+		if bCount == 0 {
+			bLine--
+		}
+		out.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", aLine, aCount, bLine, bCount))
+		for _, op := range ops[first:last] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			out.WriteString("\n")
+		}
+		start = last
+	}
+	return out.String()
+}
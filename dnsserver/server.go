@@ -0,0 +1,500 @@
+// Package dnsserver serves the hosts stored in etcd over DNS, for clients that
+// can't use a hosts file, e.g. containers or appliances.
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	etcdhosts "github.com/mritd/etcdhosts-client"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultTTL is the TTL of the answered records if Server.TTL is 0.
+	DefaultTTL = 60
+
+	// maxUDPSize is the largest response sent over UDP, bigger responses are
+	// truncated so the client retries over TCP.
+	maxUDPSize = 512
+
+	tcpIdleTimeout  = 10 * time.Second
+	upstreamTimeout = 3 * time.Second
+)
+
+// Server answers A, AAAA and PTR queries from the enabled entries of the
+// hosts, wildcard entries answer A and AAAA queries like HostList.Resolve.
+// Queries for other names are forwarded to Upstream, or answered with
+// NXDOMAIN if no upstream is configured. The fields must not be changed after
+// Start.
+type Server struct {
+	Client *etcdhosts.HostsClient
+	// Addr is the UDP and TCP address to listen on, e.g. "127.0.0.1:53". A
+	// port of 0 picks a free port, see LocalAddr.
+	Addr string
+	// Upstream is the "host:port" of a DNS server to forward unknown names
+	// to, the port defaults to 53.
+	Upstream string
+	// TTL of the answered records, DefaultTTL if 0.
+	TTL uint32
+	// OnError is called with errors that don't stop the server, e.g. watch
+	// failures or a failed upstream query. It may be nil.
+	OnError func(error)
+
+	mu   sync.RWMutex
+	zone *zone
+
+	udp  net.PacketConn
+	tcp  net.Listener
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+// NewServer creates a Server which serves the hosts of client on addr.
+func NewServer(client *etcdhosts.HostsClient, addr string) *Server {
+	return &Server{
+		Client: client,
+		Addr:   addr,
+		zone:   newZone(nil),
+	}
+}
+
+// SetHosts replaces the served records with the enabled entries of hosts.
+func (s *Server) SetHosts(hosts etcdhosts.HostList) {
+	z := newZone(hosts)
+	s.mu.Lock()
+	s.zone = z
+	s.mu.Unlock()
+}
+
+// Start binds the UDP and TCP listeners and serves queries in the background
+// until Close is called.
+func (s *Server) Start() error {
+	udp, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("[dnsserver] listen udp %s failed: %w", s.Addr, err)
+	}
+	// listen on the same port as UDP, which matters if the port was 0
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		_ = udp.Close()
+		return fmt.Errorf("[dnsserver] listen tcp %s failed: %w", s.Addr, err)
+	}
+
+	s.udp, s.tcp = udp, tcp
+	s.done = make(chan struct{})
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	return nil
+}
+
+// LocalAddr returns the address the server listens on, it is nil before
+// Start.
+func (s *Server) LocalAddr() net.Addr {
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// Close stops the listeners and waits for the running queries to finish.
+func (s *Server) Close() error {
+	if s.udp == nil {
+		return nil
+	}
+	close(s.done)
+	err := s.udp.Close()
+	if tcpErr := s.tcp.Close(); err == nil {
+		err = tcpErr
+	}
+	s.wg.Wait()
+	s.udp, s.tcp = nil, nil
+	return err
+}
+
+// Run starts the server and reloads the records on every change of the hosts
+// until ctx is done.
+func (s *Server) Run(ctx context.Context) error {
+	err := s.Start()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = s.Close() }()
+
+	for event := range s.Client.WatchHosts(ctx) {
+		if event.Err != nil {
+			s.reportError(event.Err)
+			continue
+		}
+		s.SetHosts(event.HostFile.Hosts)
+	}
+	return ctx.Err()
+}
+
+func (s *Server) reportError(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+func (s *Server) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if s.closed() {
+				return
+			}
+			s.reportError(fmt.Errorf("[dnsserver] read udp failed: %w", err))
+			continue
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			resp := s.handle(query, "udp")
+			if resp == nil {
+				return
+			}
+			if _, err := s.udp.WriteTo(resp, addr); err != nil && !s.closed() {
+				s.reportError(fmt.Errorf("[dnsserver] write udp failed: %w", err))
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if s.closed() {
+				return
+			}
+			s.reportError(fmt.Errorf("[dnsserver] accept tcp failed: %w", err))
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn answers length prefixed queries until the client goes idle or the
+// server is closed.
+func (s *Server) serveConn(conn net.Conn) {
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-s.done:
+		case <-finished:
+		}
+		_ = conn.Close()
+	}()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := s.handle(query, "tcp")
+		if resp == nil {
+			return
+		}
+		if err = writeTCPMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// handle returns the response to query, or nil if the query is too broken to
+// answer at all.
+func (s *Server) handle(query []byte, network string) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+
+	header.Response = true
+	header.Authoritative = false
+	header.Truncated = false
+	header.RecursionAvailable = s.Upstream != ""
+
+	question, err := p.Question()
+	if err != nil {
+		header.RCode = dnsmessage.RCodeFormatError
+		return s.pack(header, nil, nil, network)
+	}
+	if header.OpCode != 0 {
+		header.RCode = dnsmessage.RCodeNotImplemented
+		return s.pack(header, &question, nil, network)
+	}
+
+	s.mu.RLock()
+	z := s.zone
+	s.mu.RUnlock()
+
+	answers, ok := z.lookup(question, s.ttl())
+	if !ok {
+		if s.Upstream != "" {
+			resp, err := s.forward(query, network)
+			if err == nil {
+				return resp
+			}
+			s.reportError(err)
+			header.RCode = dnsmessage.RCodeServerFailure
+			return s.pack(header, &question, nil, network)
+		}
+		header.RCode = dnsmessage.RCodeNameError
+		return s.pack(header, &question, nil, network)
+	}
+
+	header.Authoritative = true
+	header.RCode = dnsmessage.RCodeSuccess
+	return s.pack(header, &question, answers, network)
+}
+
+func (s *Server) ttl() uint32 {
+	if s.TTL == 0 {
+		return DefaultTTL
+	}
+	return s.TTL
+}
+
+// pack builds the response message, UDP responses which don't fit into
+// maxUDPSize are sent truncated without answers.
+func (s *Server) pack(header dnsmessage.Header, question *dnsmessage.Question, answers []dnsmessage.Resource, network string) []byte {
+	msg := dnsmessage.Message{Header: header, Answers: answers}
+	if question != nil {
+		msg.Questions = []dnsmessage.Question{*question}
+	}
+	resp, err := msg.Pack()
+	if err != nil {
+		s.reportError(fmt.Errorf("[dnsserver] pack response failed: %w", err))
+		return nil
+	}
+	if network == "udp" && len(resp) > maxUDPSize {
+		msg.Header.Truncated = true
+		msg.Answers = nil
+		resp, err = msg.Pack()
+		if err != nil {
+			s.reportError(fmt.Errorf("[dnsserver] pack response failed: %w", err))
+			return nil
+		}
+	}
+	return resp
+}
+
+// forward sends query to the upstream server using the same network it was
+// received on and returns the raw response.
+func (s *Server) forward(query []byte, network string) ([]byte, error) {
+	upstream := s.Upstream
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+
+	conn, err := net.DialTimeout(network, upstream, upstreamTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("[dnsserver] dial upstream %s failed: %w", upstream, err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if network == "tcp" {
+		if err = writeTCPMessage(conn, query); err != nil {
+			return nil, fmt.Errorf("[dnsserver] query upstream %s failed: %w", upstream, err)
+		}
+		resp, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("[dnsserver] read upstream %s failed: %w", upstream, err)
+		}
+		return resp, nil
+	}
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, fmt.Errorf("[dnsserver] query upstream %s failed: %w", upstream, err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("[dnsserver] read upstream %s failed: %w", upstream, err)
+	}
+	return buf[:n], nil
+}
+
+// zone is an immutable snapshot of the served records, keyed by lower case
+// fully qualified names.
+type zone struct {
+	a    map[string][]net.IP
+	aaaa map[string][]net.IP
+	ptr  map[string][]string
+}
+
+func newZone(hosts etcdhosts.HostList) *zone {
+	z := &zone{
+		a:    map[string][]net.IP{},
+		aaaa: map[string][]net.IP{},
+		ptr:  map[string][]string{},
+	}
+	for _, hostname := range hosts {
+		if !hostname.Enabled || hostname.IP == nil {
+			continue
+		}
+		name := fqdn(hostname.Domain)
+		if hostname.IP.To4() != nil && !hostname.IPv6 {
+			z.a[name] = append(z.a[name], hostname.IP.To4())
+		} else {
+			z.aaaa[name] = append(z.aaaa[name], hostname.IP.To16())
+		}
+		if hostname.IsWildcard() {
+			continue
+		}
+		reverse := ReverseName(hostname.IP)
+		z.ptr[reverse] = append(z.ptr[reverse], name)
+	}
+	return z
+}
+
+// lookup returns the answers to question and whether the name is served by
+// the zone. A known name without records of the asked type yields no answers.
+func (z *zone) lookup(question dnsmessage.Question, ttl uint32) ([]dnsmessage.Resource, bool) {
+	if question.Class != dnsmessage.ClassINET {
+		return nil, false
+	}
+	name := strings.ToLower(question.Name.String())
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+
+	if names, ok := z.ptr[name]; ok {
+		var answers []dnsmessage.Resource
+		if question.Type == dnsmessage.TypePTR {
+			for _, target := range names {
+				ptr, err := dnsmessage.NewName(target)
+				if err != nil {
+					continue
+				}
+				rh.Type = dnsmessage.TypePTR
+				answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.PTRResource{PTR: ptr}})
+			}
+		}
+		return answers, true
+	}
+
+	a, aaaa, ok := z.records(name)
+	if !ok {
+		return nil, false
+	}
+
+	var answers []dnsmessage.Resource
+	switch question.Type {
+	case dnsmessage.TypeA:
+		rh.Type = dnsmessage.TypeA
+		for _, ip := range a {
+			body := &dnsmessage.AResource{}
+			copy(body.A[:], ip)
+			answers = append(answers, dnsmessage.Resource{Header: rh, Body: body})
+		}
+	case dnsmessage.TypeAAAA:
+		rh.Type = dnsmessage.TypeAAAA
+		for _, ip := range aaaa {
+			body := &dnsmessage.AAAAResource{}
+			copy(body.AAAA[:], ip)
+			answers = append(answers, dnsmessage.Resource{Header: rh, Body: body})
+		}
+	}
+	return answers, true
+}
+
+// records returns the addresses of name, falling back to the wildcard with
+// the longest matching suffix like HostList.Resolve.
+func (z *zone) records(name string) (a, aaaa []net.IP, ok bool) {
+	a, hasA := z.a[name]
+	aaaa, hasAAAA := z.aaaa[name]
+	if hasA || hasAAAA {
+		return a, aaaa, true
+	}
+	// "a.b.example." tries "*.b.example." and then "*.example."
+	for i := strings.IndexByte(name, '.'); i >= 0 && i < len(name)-1; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		a, hasA = z.a["*."+name]
+		aaaa, hasAAAA = z.aaaa["*."+name]
+		if hasA || hasAAAA {
+			return a, aaaa, true
+		}
+	}
+	return nil, nil, false
+}
+
+func fqdn(domain string) string {
+	domain = strings.ToLower(domain)
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+	return domain
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name of ip which is used
+// by PTR queries.
+func ReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	const hexDigits = "0123456789abcdef"
+	b := strings.Builder{}
+	for i := len(ip16) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip16[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip16[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
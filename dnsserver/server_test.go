@@ -0,0 +1,236 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	etcdhosts "github.com/mritd/etcdhosts-client"
+	"github.com/mritd/etcdhosts-client/internal/etcdtest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func startServer(t *testing.T, hosts, upstream string) *Server {
+	hostFile, err := etcdhosts.NewHostFile([]byte(hosts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(nil, "127.0.0.1:0")
+	s.Upstream = upstream
+	s.SetHosts(hostFile.Hosts)
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func query(t *testing.T, network string, addr net.Addr, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	req, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial(network, addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var resp []byte
+	if network == "tcp" {
+		if err = writeTCPMessage(conn, req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err = readTCPMessage(conn)
+	} else {
+		if _, err = conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 65535)
+		var n int
+		n, err = conn.Read(buf)
+		resp = buf[:n]
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out dnsmessage.Message
+	if err = out.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if out.Header.ID != 42 || !out.Header.Response {
+		t.Fatalf("unexpected header %+v", out.Header)
+	}
+	return out
+}
+
+func TestServer(t *testing.T) {
+	s := startServer(t, "10.99.0.1 web.test\n10.99.0.1 Alias.test\nfd00::1 web.test\n# 10.99.0.2 off.test\n"+
+		"# etcdhosts: wildcard 10.99.0.5 *.preview.test\n", "")
+	defer func() { _ = s.Close() }()
+
+	for _, network := range []string{"udp", "tcp"} {
+		resp := query(t, network, s.LocalAddr(), "WEB.test.", dnsmessage.TypeA)
+		if resp.RCode != dnsmessage.RCodeSuccess || !resp.Authoritative || len(resp.Answers) != 1 {
+			t.Fatalf("%s: unexpected A response %+v", network, resp)
+		}
+		if a := resp.Answers[0].Body.(*dnsmessage.AResource).A; net.IP(a[:]).String() != "10.99.0.1" {
+			t.Fatalf("%s: unexpected A %v", network, a)
+		}
+
+		resp = query(t, network, s.LocalAddr(), "web.test.", dnsmessage.TypeAAAA)
+		if len(resp.Answers) != 1 {
+			t.Fatalf("%s: unexpected AAAA response %+v", network, resp)
+		}
+		if aaaa := resp.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA; net.IP(aaaa[:]).String() != "fd00::1" {
+			t.Fatalf("%s: unexpected AAAA %v", network, aaaa)
+		}
+
+		resp = query(t, network, s.LocalAddr(), "alias.test.", dnsmessage.TypeAAAA)
+		if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 0 {
+			t.Fatalf("%s: expected NODATA, got %+v", network, resp)
+		}
+
+		resp = query(t, network, s.LocalAddr(), "1.0.99.10.in-addr.arpa.", dnsmessage.TypePTR)
+		if len(resp.Answers) != 2 {
+			t.Fatalf("%s: unexpected PTR response %+v", network, resp)
+		}
+		if ptr := resp.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String(); ptr != "web.test." && ptr != "alias.test." {
+			t.Fatalf("%s: unexpected PTR %s", network, ptr)
+		}
+
+		resp = query(t, network, s.LocalAddr(), "a.b.preview.test.", dnsmessage.TypeA)
+		if len(resp.Answers) != 1 {
+			t.Fatalf("%s: unexpected wildcard response %+v", network, resp)
+		}
+		if a := resp.Answers[0].Body.(*dnsmessage.AResource).A; net.IP(a[:]).String() != "10.99.0.5" {
+			t.Fatalf("%s: unexpected wildcard A %v", network, a)
+		}
+
+		for _, name := range []string{"off.test.", "unknown.test.", "preview.test."} {
+			resp = query(t, network, s.LocalAddr(), name, dnsmessage.TypeA)
+			if resp.RCode != dnsmessage.RCodeNameError {
+				t.Fatalf("%s: expected NXDOMAIN for %s, got %v", network, name, resp.RCode)
+			}
+		}
+	}
+
+	// reload
+	s.SetHosts(etcdhosts.MustParseLine("10.99.0.3 web.test"))
+	resp := query(t, "udp", s.LocalAddr(), "web.test.", dnsmessage.TypeA)
+	if a := resp.Answers[0].Body.(*dnsmessage.AResource).A; net.IP(a[:]).String() != "10.99.0.3" {
+		t.Fatalf("unexpected A after reload %v", a)
+	}
+}
+
+func TestServerUpstream(t *testing.T) {
+	upstream := startServer(t, "10.99.1.1 other.test\n", "")
+	defer func() { _ = upstream.Close() }()
+
+	s := startServer(t, "10.99.0.1 web.test\n", upstream.LocalAddr().String())
+	defer func() { _ = s.Close() }()
+
+	for _, network := range []string{"udp", "tcp"} {
+		resp := query(t, network, s.LocalAddr(), "other.test.", dnsmessage.TypeA)
+		if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+			t.Fatalf("%s: unexpected forwarded response %+v", network, resp)
+		}
+		resp = query(t, network, s.LocalAddr(), "unknown.test.", dnsmessage.TypeA)
+		if resp.RCode != dnsmessage.RCodeNameError {
+			t.Fatalf("%s: expected NXDOMAIN from upstream, got %v", network, resp.RCode)
+		}
+	}
+}
+
+// waitForA queries name over TCP until the server at addr answers with ip.
+func waitForA(t *testing.T, addr net.Addr, name, ip string) {
+	deadline := time.Now().Add(10 * time.Second)
+	var last []dnsmessage.Resource
+	for time.Now().Before(deadline) {
+		// the server may not listen yet
+		if conn, err := net.Dial("tcp", addr.String()); err == nil {
+			_ = conn.Close()
+			last = query(t, "tcp", addr, name, dnsmessage.TypeA).Answers
+			if len(last) == 1 {
+				if a := last[0].Body.(*dnsmessage.AResource).A; net.IP(a[:]).String() == ip {
+					return
+				}
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("no A %s for %s, last answers %+v", ip, name, last)
+}
+
+func TestServerRun(t *testing.T) {
+	endpoint := etcdtest.Start(t, nil)
+	cli, err := etcdhosts.NewClientWithOptions([]string{endpoint}, "/dns", etcdhosts.WithRequestTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = cli.Close() }()
+	hostFile, err := etcdhosts.NewHostFile([]byte("10.99.0.1 web.test\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.PutHosts(hostFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run binds the listeners itself, so pick a free port beforehand
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.LocalAddr()
+	_ = l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewServer(cli, addr.String())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	waitForA(t, addr, "web.test.", "10.99.0.1")
+
+	// changes of the hosts key are served without a restart
+	if hostFile, err = etcdhosts.NewHostFile([]byte("10.99.0.2 web.test\n10.99.0.3 api.test\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.PutHosts(hostFile); err != nil {
+		t.Fatal(err)
+	}
+	waitForA(t, addr, "web.test.", "10.99.0.2")
+	waitForA(t, addr, "api.test.", "10.99.0.3")
+
+	cancel()
+	select {
+	case err = <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("unexpected Run error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not stop")
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	if name := ReverseName(net.ParseIP("1.2.3.4")); name != "4.3.2.1.in-addr.arpa." {
+		t.Fatal(name)
+	}
+	name := ReverseName(net.ParseIP("2001:db8::1"))
+	if name != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa." {
+		t.Fatal(name)
+	}
+}
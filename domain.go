@@ -0,0 +1,167 @@
+package etcdhosts_client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// ErrInvalidDomain is wrapped by the errors of ValidateDomain and NewHostname.
+var ErrInvalidDomain = errors.New("invalid domain")
+
+// DomainValidation selects how strictly ValidateDomain checks a domain.
+type DomainValidation int
+
+const (
+	// DomainHostname allows labels of letters, digits, hyphens and
+	// underscores, which is what resolvers accept in practice.
+	DomainHostname DomainValidation = iota
+	// DomainRFC1123 only allows letters, digits and hyphens as required by
+	// RFC 1123.
+	DomainRFC1123
+	// DomainAny only enforces the length limits and rejects empty labels,
+	// whitespace, "#", "/" and control characters. NewHostname applies it to
+	// every domain.
+	DomainAny
+)
+
+// idnaProfile maps Unicode domains for lookup, e.g. lower cases them, but
+// leaves the ASCII rules to ValidateDomain.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.Transitional(false), idna.StrictDomainName(false))
+
+// wildcardPrefix starts a wildcard domain, e.g. "*.preview.internal".
+const wildcardPrefix = "*."
+
+// IsWildcardDomain reports whether domain is a wildcard pattern like
+// "*.preview.internal", which matches every name below preview.internal.
+func IsWildcardDomain(domain string) bool {
+	return strings.HasPrefix(domain, wildcardPrefix) && len(domain) > len(wildcardPrefix)
+}
+
+// ValidateDomain checks the ASCII form of domain, Unicode domains have to be
+// converted with ToASCIIDomain first. Labels must not start or end with a
+// hyphen except with DomainAny. The first label may be "*" to make domain a
+// wildcard, see IsWildcardDomain. The domains "_ephemeral" and "_generation"
+// are reserved for the registrations of RegisterHost and the generations of
+// LayoutEntries.
+func ValidateDomain(domain string, v DomainValidation) error {
+	if domain == "" {
+		return fmt.Errorf("%w: empty domain", ErrInvalidDomain)
+	}
+	if strings.EqualFold(domain, ephemeralName) || strings.EqualFold(domain, generationName) {
+		return fmt.Errorf("%w %q: reserved domain", ErrInvalidDomain, domain)
+	}
+	if len(domain) > 253 {
+		return fmt.Errorf("%w %q: longer than 253 characters", ErrInvalidDomain, domain)
+	}
+	for i, label := range strings.Split(domain, ".") {
+		if label == "" {
+			return fmt.Errorf("%w %q: empty label", ErrInvalidDomain, domain)
+		}
+		if i == 0 && IsWildcardDomain(domain) {
+			continue
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("%w %q: label longer than 63 characters", ErrInvalidDomain, domain)
+		}
+		if v != DomainAny && (label[0] == '-' || label[len(label)-1] == '-') {
+			return fmt.Errorf("%w %q: label starts or ends with a hyphen", ErrInvalidDomain, domain)
+		}
+		for i := 0; i < len(label); i++ {
+			if !validDomainChar(label[i], v) {
+				return fmt.Errorf("%w %q: invalid character %q", ErrInvalidDomain, domain, label[i])
+			}
+		}
+	}
+	return nil
+}
+
+func validDomainChar(c byte, v DomainValidation) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+		return true
+	case c == '_':
+		return v != DomainRFC1123
+	}
+	// "/" separates the domain in the keys of LayoutEntries
+	return v == DomainAny && c > ' ' && c != '#' && c != '/' && c != 0x7f
+}
+
+// ToASCIIDomain converts a Unicode domain to its punycode form, e.g.
+// "bücher.example" to "xn--bcher-kva.example". ASCII domains are returned
+// unchanged.
+func ToASCIIDomain(domain string) (string, error) {
+	if isASCII(domain) {
+		return domain, nil
+	}
+	ascii, err := idnaProfile.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %v", ErrInvalidDomain, domain, err)
+	}
+	return ascii, nil
+}
+
+// ToUnicodeDomain converts the punycode labels of domain back to Unicode for
+// display, it returns domain unchanged if it can't be converted.
+func ToUnicodeDomain(domain string) string {
+	if !strings.Contains(domain, "xn--") && !strings.Contains(domain, "XN--") {
+		return domain
+	}
+	unicode, err := idna.ToUnicode(domain)
+	if err != nil {
+		return domain
+	}
+	return unicode
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalDomain converts a domain given to a lookup function like
+// ContainsDomain into the form stored in Hostname.Domain, the result is still
+// compared case-insensitively.
+func canonicalDomain(domain string) string {
+	ascii, err := ToASCIIDomain(domain)
+	if err != nil {
+		return domain
+	}
+	return ascii
+}
+
+// compareDomains compares two ASCII domains ignoring case and falls back to
+// a byte comparison, so the order is stable for domains differing only in
+// case.
+func compareDomains(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := lowerASCII(a[i]), lowerASCII(b[i])
+		if ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func lowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -0,0 +1,194 @@
+package etcdhosts_client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+// ephemeralName names the sub directory of the hosts key which holds the
+// lease backed registrations, ValidateDomain rejects it as a domain so it
+// can't clash with an entry.
+const ephemeralName = "_ephemeral"
+
+const ephemeralDir = "/" + ephemeralName + "/"
+
+// Registration is a Hostname registered with RegisterHost. It stays in etcd as
+// long as its lease is kept alive, which happens in the background until
+// Close is called or the client loses the lease.
+type Registration struct {
+	Hostname *Hostname
+
+	cli     *clientv3.Client
+	leaseID clientv3.LeaseID
+	cancel  context.CancelFunc
+	done    chan struct{}
+	once    sync.Once
+}
+
+// LeaseID returns the etcd lease the registration is attached to.
+func (r *Registration) LeaseID() clientv3.LeaseID {
+	return r.leaseID
+}
+
+// Done returns a channel which is closed once the lease is no longer kept
+// alive, either because Close was called or because the lease expired.
+func (r *Registration) Done() <-chan struct{} {
+	return r.done
+}
+
+// Close stops the keepalive and revokes the lease, which removes the entry
+// from etcd immediately. ctx is used for the revoke request.
+func (r *Registration) Close(ctx context.Context) error {
+	var err error
+	r.once.Do(func() {
+		r.cancel()
+		_, err = r.cli.Revoke(ctx, r.leaseID)
+	})
+	if err != nil {
+		return fmt.Errorf("[etcd/client/lease] revoke lease %x failed: %w", r.leaseID, err)
+	}
+	return nil
+}
+
+// RegisterHost stores hostname under a lease of ttl seconds and keeps the
+// lease alive in the background. If the process dies the lease expires and
+// the entry disappears. Registered entries are merged into the results of
+// GetHosts and WatchHosts, an entry of the static hosts with the same domain
+// and IP version takes precedence over a registration. Every registration
+// has its own key, so several owners can register the same domain: with
+// WithMultiAddress all their addresses are merged, otherwise one of them
+// is used, and the domain stays as long as any of them is alive.
+func (hc *HostsClient) RegisterHost(ctx context.Context, hostname *Hostname, ttl int64) (*Registration, error) {
+	if !hostname.IsValid() {
+		return nil, fmt.Errorf("[etcd/client/lease] invalid hostname %s -> %s", hostname.Domain, hostname.IP)
+	}
+	value, err := json.Marshal(hostname)
+	if err != nil {
+		return nil, fmt.Errorf("[etcd/client/lease] marshal hostname failed: %w", err)
+	}
+
+	lease, err := hc.cli.Grant(ctx, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("[etcd/client/lease] grant lease failed: %w", err)
+	}
+	key := hc.ephemeralKey(hostname, lease.ID)
+	_, err = hc.cli.Put(ctx, key, string(value), clientv3.WithLease(lease.ID))
+	if err != nil {
+		_, _ = hc.cli.Revoke(context.Background(), lease.ID)
+		return nil, fmt.Errorf("[etcd/client/lease] register hostname failed, key %s: %w", key, err)
+	}
+
+	// the keepalive must outlive ctx, it is stopped by Close
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	keepAlive, err := hc.cli.KeepAlive(keepAliveCtx, lease.ID)
+	if err != nil {
+		cancel()
+		_, _ = hc.cli.Revoke(context.Background(), lease.ID)
+		return nil, fmt.Errorf("[etcd/client/lease] keepalive lease %x failed: %w", lease.ID, err)
+	}
+
+	r := &Registration{
+		Hostname: hostname,
+		cli:      hc.cli,
+		leaseID:  lease.ID,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		for range keepAlive {
+		}
+	}()
+	return r, nil
+}
+
+// GetEphemeralHosts returns all currently registered hostnames.
+func (hc *HostsClient) GetEphemeralHosts(ctx context.Context) (HostList, error) {
+	resp, err := hc.cli.Get(ctx, hc.ephemeralPrefix(), clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("[etcd/client/get] get ephemeral hosts failed, key %s: %w", hc.ephemeralPrefix(), err)
+	}
+	hostnames := HostList{}
+	for _, kv := range resp.Kvs {
+		hostname, err := decodeHostname(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("[etcd/client/get] %w, key %s", err, kv.Key)
+		}
+		hostnames = append(hostnames, hostname)
+	}
+	return hostnames, nil
+}
+
+func (hc *HostsClient) ephemeralPrefix() string {
+	return hc.hostKey + ephemeralDir
+}
+
+// ephemeralKey returns the key of the registration of hostname under
+// leaseID, "<hostKey>/_ephemeral/<domain>/<4|6>/<leaseID>".
+func (hc *HostsClient) ephemeralKey(hostname *Hostname, leaseID clientv3.LeaseID) string {
+	return fmt.Sprintf("%s%s/%x", hc.ephemeralPrefix(), entryName(hostname.Domain, ipVersion(hostname)), leaseID)
+}
+
+func (hc *HostsClient) isEphemeralKey(key string) bool {
+	return strings.HasPrefix(key, hc.ephemeralPrefix())
+}
+
+func decodeHostname(value []byte) (*Hostname, error) {
+	var hostname Hostname
+	err := json.Unmarshal(value, &hostname)
+	if err != nil {
+		return nil, fmt.Errorf("decode hostname failed: %w", err)
+	}
+	if !hostname.IsValid() {
+		return nil, errors.New("invalid hostname")
+	}
+	decoded, err := NewHostname(hostname.Domain, hostname.IPString(), hostname.Enabled)
+	if err != nil {
+		return nil, err
+	}
+	decoded.copyAnnotations(&hostname)
+	return decoded, nil
+}
+
+// mergeEphemeral adds the registered hostnames to hostFile and marks them as
+// Ephemeral. Static entries win over registrations of the same domain and IP
+// version. Registrations of the same domain and IP version are all added
+// with multi, see HostList.AddAddress, otherwise the last one wins.
+func mergeEphemeral(hostFile *HostFile, ephemeral []*Hostname, multi bool) {
+	index := newHostIndex(hostFile.Hosts)
+	static := make(map[domainKey]bool, len(index))
+	for key, positions := range index {
+		static[key] = len(positions) > 0
+	}
+	for _, hostname := range ephemeral {
+		if static[keyOf(hostname)] {
+			continue
+		}
+		registered, err := NewHostname(hostname.Domain, hostname.IPString(), hostname.Enabled)
+		if err != nil {
+			continue
+		}
+		registered.copyAnnotations(hostname)
+		registered.Ephemeral = true
+		_ = hostFile.Hosts.insert(registered, multi, index)
+	}
+}
+
+// staticData formats hostFile for the hosts key, leaving out the ephemeral
+// entries and the marker of a previous rollback.
+func staticData(hostFile *HostFile) []byte {
+	return stripRollbackMarker(hostFile.format(runtime.GOOS, false))
+}
+
+// decodeHostFile parses a value of the hosts key, comments and order are
+// preserved so they survive a round trip through GetHosts and PutHosts.
+func decodeHostFile(data []byte, multiAddress bool) (*HostFile, error) {
+	return NewHostFileWithOptions(data, ParseOptions{Preserve: true, MultiAddress: multiAddress})
+}
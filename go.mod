@@ -5,5 +5,6 @@ go 1.15
 require (
 	github.com/mitchellh/go-homedir v1.1.0
 	go.etcd.io/etcd v0.5.0-alpha.5.0.20201125193152-8a03d2e9614b
+	golang.org/x/net v0.0.0-20190813141303-74dc4d7220e7
 	golang.org/x/tools v0.0.0-20190524140312-2c0ae7006135 // indirect
 )
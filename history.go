@@ -0,0 +1,150 @@
+package etcdhosts_client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+// HistoryOptions limits the versions returned by GetHostsHistoryWithOptions.
+// The zero value returns every version that is still available.
+type HistoryOptions struct {
+	// Limit is the maximum number of versions to return, 0 means no limit.
+	Limit int
+	// Since stops the walk at versions modified before this revision.
+	Since int64
+	// Before only returns versions modified before this revision, it can be
+	// set to the Revision of the oldest version of the previous page.
+	Before int64
+}
+
+// HostsHistory is the result of GetHostsHistoryWithOptions.
+type HostsHistory struct {
+	// Versions is sorted from newest to oldest.
+	Versions VHostsList
+	// Truncated is set if older versions exist but were compacted, in that
+	// case CompactRevision is the revision that could no longer be read.
+	Truncated       bool
+	CompactRevision int64
+}
+
+// GetHostsHistory returns every version of the hosts that is still available,
+// newest first. Versions lost to compaction are silently left out, use
+// GetHostsHistoryWithOptions to find out whether the history is complete.
+func (hc *HostsClient) GetHostsHistory() (VHostsList, error) {
+	history, err := hc.getHostsHistory(context.Background(), hc.requestTimeout, HistoryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return history.Versions, nil
+}
+
+// GetHostsHistoryContext is like GetHostsHistory but uses ctx for all
+// requests, the history walk stops as soon as ctx is done.
+func (hc *HostsClient) GetHostsHistoryContext(ctx context.Context) (VHostsList, error) {
+	history, err := hc.getHostsHistory(ctx, 0, HistoryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return history.Versions, nil
+}
+
+// GetHostsHistoryWithOptions returns the versions of the hosts selected by
+// opts, newest first, and reports whether the history was cut off by
+// compaction.
+func (hc *HostsClient) GetHostsHistoryWithOptions(ctx context.Context, opts HistoryOptions) (*HostsHistory, error) {
+	return hc.getHostsHistory(ctx, 0, opts)
+}
+
+// getHostsHistory follows the modification chain of the hosts key: the
+// version read at revision ModRevision-1 is the previous version, so only one
+// request per version is needed no matter how busy the cluster is. Every
+// request gets its own timeout if timeout is greater than zero. With
+// LayoutEntries every write touches the hosts key as well, so the chain is the
+// same, only the entries have to be read separately for each version, with a
+// timeout of their own.
+func (hc *HostsClient) getHostsHistory(ctx context.Context, timeout time.Duration, opts HistoryOptions) (*HostsHistory, error) {
+	withTimeout := func() (context.Context, context.CancelFunc) {
+		if timeout > 0 {
+			return context.WithTimeout(ctx, timeout)
+		}
+		return context.WithCancel(ctx)
+	}
+
+	history := &HostsHistory{Versions: VHostsList{}}
+
+	// revision 0 reads the latest version
+	var rev int64
+	if opts.Before > 0 {
+		rev = opts.Before - 1
+	}
+	for opts.Limit <= 0 || len(history.Versions) < opts.Limit {
+		getCtx, cancel := withTimeout()
+		var resp *clientv3.GetResponse
+		var err error
+		if rev > 0 {
+			resp, err = hc.cli.Get(getCtx, hc.hostKey, clientv3.WithRev(rev))
+		} else {
+			resp, err = hc.cli.Get(getCtx, hc.hostKey)
+		}
+		cancel()
+		if err == rpctypes.ErrCompacted {
+			history.Truncated = true
+			history.CompactRevision = rev
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[etcd/client/get] get hosts history failed, key %s, revision %d: %w", hc.hostKey, rev, err)
+		}
+		if rev == 0 && opts.Before == 0 && len(resp.Kvs) == 0 {
+			return nil, fmt.Errorf("[etcd/client/get] kvs not found, key %s", hc.hostKey)
+		}
+		// the key did not exist at this revision, either it was created
+		// afterwards or it was deleted
+		if len(resp.Kvs) == 0 {
+			break
+		}
+
+		kv := resp.Kvs[0]
+		if kv.ModRevision < opts.Since {
+			break
+		}
+		getCtx, cancel = withTimeout()
+		hostFile, err := hc.hostsOfVersion(getCtx, kv)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("[etcd/client/get] parse hosts failed, key %s, revision %d: %w", hc.hostKey, kv.ModRevision, err)
+		}
+		history.Versions = append(history.Versions, VHosts{
+			Version:  kv.Version,
+			Revision: kv.ModRevision,
+			HostFile: hostFile,
+		})
+
+		// the first version of the key has no predecessor, reading before it
+		// would only fail if that revision was compacted
+		if kv.Version == 1 {
+			break
+		}
+		rev = kv.ModRevision - 1
+	}
+	sort.Sort(history.Versions)
+	return history, nil
+}
+
+// hostsOfVersion decodes the hosts of a version of the hosts key.
+func (hc *HostsClient) hostsOfVersion(ctx context.Context, kv *mvccpb.KeyValue) (*HostFile, error) {
+	if hc.layout != LayoutEntries {
+		return decodeHostFile(kv.Value, hc.multiAddress)
+	}
+	vh, err := hc.getEntries(ctx, kv.ModRevision)
+	if err != nil {
+		return nil, err
+	}
+	return vh.HostFile, nil
+}
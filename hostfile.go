@@ -1,7 +1,12 @@
 package etcdhosts_client
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"runtime"
 	"strings"
 )
 
@@ -32,45 +37,315 @@ ff02::2 ip6-allrouters
 ff02::3 ip6-allhosts
 `
 
+// ParseOptions controls how NewHostFileWithOptions parses a hosts file.
+type ParseOptions struct {
+	// Preserve keeps comments, blank lines, trailing comments and the
+	// original order of the lines, so Format reproduces the input byte for
+	// byte as long as the Hosts are not changed. Lines of changed entries are
+	// rewritten and new entries are appended at the end.
+	Preserve bool
+	// Strict rejects entry lines with an invalid IP or domain, or without a
+	// domain, instead of reporting them as warnings.
+	Strict bool
+	// Domains selects how strictly the domains of entry lines are checked.
+	// Domains failing only this check are kept unless Strict is set.
+	Domains DomainValidation
+	// MultiAddress keeps every address of a domain and IP version, see
+	// HostList.AddAddress. Otherwise the last entry wins.
+	MultiAddress bool
+}
+
 // HostFile represents /etc/hosts (or a similar file, depending on OS), and
 // includes a list of Hostnames. HostFile includes
 type HostFile struct {
 	Hosts HostList
+	// Stale is set if the HostFile was served from the local cache because
+	// etcd could not be reached.
+	Stale bool
 	data  []byte
+	opts  ParseOptions
+	lines []*hostLine
+	// superseded maps Hostnames of the lines which were replaced by a
+	// conflicting or duplicate entry of another line to that entry
+	superseded map[*Hostname]*Hostname
+	// warnings are the non fatal problems found by Parse
+	warnings []*ParseError
+	// header is the first non blank line found by Parse, see RollbackOf
+	header string
+}
+
+type lineKind int
+
+const (
+	lineBlank lineKind = iota
+	lineComment
+	lineEntry
+)
+
+// hostLine is a line of a HostFile parsed with ParseOptions.Preserve.
+type hostLine struct {
+	raw  string
+	kind lineKind
+	// hostnames point into HostFile.Hosts, snapshot holds their state at
+	// parse time so changes can be detected
+	hostnames []*Hostname
+	snapshot  []Hostname
+}
+
+// lineChanged reports whether any Hostname of the line was changed or
+// removed.
+func (h *HostFile) lineChanged(l *hostLine, present map[*Hostname]bool) bool {
+	for i, hostname := range l.hostnames {
+		if !present[hostname] {
+			// the line still reads the same as long as the entry
+			// overriding it is there
+			if h.winnerOf(hostname, present) != nil {
+				continue
+			}
+			return true
+		}
+		old := l.snapshot[i]
+		if hostname.Domain != old.Domain || !hostname.EqualAddr(&old) || hostname.Enabled != old.Enabled ||
+			hostname.FormatComment() != old.FormatComment() {
+			return true
+		}
+	}
+	return false
+}
+
+// winnerOf follows the chain of entries hostname was superseded by and
+// returns the first one which is present, nil if there is none.
+func (h *HostFile) winnerOf(hostname *Hostname, present map[*Hostname]bool) *Hostname {
+	// a chain can't be longer than the map, this also stops at a cycle
+	for i := 0; i < len(h.superseded); i++ {
+		winner := h.superseded[hostname]
+		if winner == nil {
+			return nil
+		}
+		if present[winner] {
+			return winner
+		}
+		hostname = winner
+	}
+	return nil
 }
 
 // NewHostFile creates a new HostFile object from the specified file.
 func NewHostFile(data []byte) (*HostFile, error) {
-	hostFile := &HostFile{HostList{}, data}
-	errs := hostFile.Parse()
-	if errs != nil {
-		return nil, fmt.Errorf("failed to create hostfile: %s", errs)
+	return NewHostFileWithOptions(data, ParseOptions{})
+}
+
+// NewHostFileWithOptions creates a new HostFile object from the specified
+// file using opts. It fails with a *ParseError, or ParseErrors if several
+// lines are broken, only if opts.Strict is set; problems which are not fatal
+// are available from Warnings.
+func NewHostFileWithOptions(data []byte, opts ParseOptions) (*HostFile, error) {
+	hostFile := &HostFile{Hosts: HostList{}, data: data, opts: opts}
+	if err := hostFile.checkParse(hostFile.Parse()); err != nil {
+		return nil, err
 	}
-	hostFile.Hosts.Sort()
+	return hostFile, nil
+}
 
+// ParseHostFile reads a hosts file from r line by line using opts, it fails
+// like NewHostFileWithOptions or if reading r fails. Unlike NewHostFile the
+// HostFile doesn't keep a copy of the input, so GetData returns nil.
+func ParseHostFile(r io.Reader, opts ParseOptions) (*HostFile, error) {
+	hostFile := &HostFile{Hosts: HostList{}, opts: opts}
+	if err := hostFile.readFrom(r); err != nil {
+		return nil, err
+	}
 	return hostFile, nil
 }
 
-// Parse reads
+// readFrom parses the lines of r into the HostFile like ParseHostFile.
+func (h *HostFile) readFrom(r io.Reader) error {
+	errs, err := h.parse(bufio.NewReader(r))
+	if err != nil {
+		return fmt.Errorf("failed to read hostfile: %w", err)
+	}
+	return h.checkParse(errs)
+}
+
+// checkParse converts the fatal errors of Parse into the error of
+// NewHostFileWithOptions and sorts the Hosts if there are none.
+func (h *HostFile) checkParse(errs []error) error {
+	if len(errs) > 0 {
+		parseErrs := make(ParseErrors, 0, len(errs))
+		for _, err := range errs {
+			parseErrs = append(parseErrs, err.(*ParseError))
+		}
+		return parseErrs.errorOf()
+	}
+	h.Hosts.Sort()
+	return nil
+}
+
+// Parse reads the data of the HostFile into Hosts and returns the fatal
+// errors, each a *ParseError. In strict mode entry lines with an invalid IP,
+// an invalid domain or without any domain are fatal, otherwise they are only
+// recorded as warnings. Duplicate and conflicting entries are always
+// warnings. Commented lines which don't parse as entries are plain comments.
 func (h *HostFile) Parse() []error {
+	// reading from memory doesn't fail
+	errs, _ := h.parse(bufio.NewReader(bytes.NewReader(h.data)))
+	return errs
+}
+
+// parse reads the lines of r, see Parse. The error is that of r.
+func (h *HostFile) parse(r *bufio.Reader) ([]error, error) {
 	var errs []error
 	var line = 1
-	for _, v := range strings.Split(string(h.data), "\n") {
-		hostnames, _ := ParseLine(v)
-		for _, hostname := range hostnames {
-			err := h.Hosts.Add(hostname)
-			if err != nil {
+	h.lines = nil
+	h.warnings = nil
+	h.header = ""
+	h.superseded = nil
+	supersede := func(replaced, winner *Hostname) {
+		if h.superseded == nil {
+			h.superseded = make(map[*Hostname]*Hostname)
+		}
+		h.superseded[replaced] = winner
+	}
+	index := newHostIndex(h.Hosts)
+	for done := false; !done; {
+		// the lines split at "\n" like strings.Split, so data ending with a
+		// newline has a final empty line
+		v, err := r.ReadString('\n')
+		switch {
+		case err == io.EOF:
+			done = true
+		case err != nil:
+			return errs, err
+		default:
+			v = v[:len(v)-1]
+		}
+		if h.header == "" {
+			h.header = strings.TrimSpace(v)
+		}
+
+		parsed := parseLine(v, line, h.opts.Domains)
+		for _, err := range parsed.errs {
+			switch {
+			case !parsed.enabled:
+				// free text comment
+			case h.opts.Strict:
 				errs = append(errs, err)
+			default:
+				h.warnings = append(h.warnings, err)
+			}
+		}
+
+		hostLine := &hostLine{raw: v, kind: lineEntry}
+		for i, hostname := range parsed.hostnames {
+			key := keyOf(hostname)
+			var replaced *Hostname
+			if positions := index[key]; len(positions) > 0 {
+				replaced = h.Hosts[positions[0]]
+			}
+			if h.opts.Preserve {
+				// insert would merge a duplicate into the Hostname of the
+				// earlier line, which then no longer reads the same. One
+				// of them supersedes the other instead, the enabled one
+				// takes over like with insert.
+				if position := h.Hosts.duplicateOf(hostname, index[key]); position >= 0 {
+					err := fmt.Errorf("%w for %s -> %s", ErrDuplicateHostname, hostname.Domain, hostname.IPString())
+					h.warnings = append(h.warnings, addError(err, line, hostname, parsed.cols[i]))
+					if found := h.Hosts[position]; hostname.Enabled && !found.Enabled {
+						h.Hosts[position] = hostname
+						supersede(found, hostname)
+					} else {
+						supersede(hostname, found)
+					}
+					hostLine.hostnames = append(hostLine.hostnames, hostname)
+					hostLine.snapshot = append(hostLine.snapshot, *hostname)
+					continue
+				}
+			}
+			// hostname is a fresh Hostname of parseLine
+			err := h.Hosts.insert(hostname, h.opts.MultiAddress, index)
+			if err != nil {
+				h.warnings = append(h.warnings, addError(err, line, hostname, parsed.cols[i]))
+				if !errors.Is(err, ErrConflictingHostname) {
+					continue
+				}
+				// the entry of this line replaced the one of an earlier
+				// line in place
+				added := h.Hosts[index[key][0]]
+				supersede(replaced, added)
+				hostLine.hostnames = append(hostLine.hostnames, added)
+				hostLine.snapshot = append(hostLine.snapshot, *added)
+				continue
 			}
+			added := h.Hosts[len(h.Hosts)-1]
+			hostLine.hostnames = append(hostLine.hostnames, added)
+			hostLine.snapshot = append(hostLine.snapshot, *added)
+		}
+		if h.opts.Preserve {
+			if len(parsed.hostnames) == 0 {
+				hostLine.kind = lineComment
+				if strings.TrimSpace(v) == "" {
+					hostLine.kind = lineBlank
+				}
+			}
+			h.lines = append(h.lines, hostLine)
 		}
 		line++
 	}
-	return errs
+	return errs, nil
+}
+
+// Warnings returns the problems found by Parse which were not fatal, in the
+// order of the lines.
+func (h *HostFile) Warnings() []*ParseError {
+	return h.warnings
+}
+
+// Clone returns a deep copy of the HostFile, including the line structure of
+// a HostFile parsed with ParseOptions.Preserve.
+func (h *HostFile) Clone() *HostFile {
+	clone := &HostFile{
+		Hosts:    make(HostList, 0, len(h.Hosts)),
+		Stale:    h.Stale,
+		data:     h.data,
+		opts:     h.opts,
+		warnings: h.warnings,
+		header:   h.header,
+	}
+	copies := make(map[*Hostname]*Hostname, len(h.Hosts))
+	for _, hostname := range h.Hosts {
+		copied := *hostname
+		copied.copyAnnotations(hostname)
+		copies[hostname] = &copied
+		clone.Hosts = append(clone.Hosts, &copied)
+	}
+	copyOf := func(hostname *Hostname) *Hostname {
+		if c, ok := copies[hostname]; ok {
+			return c
+		}
+		// removed from Hosts already, keep it so the line is still
+		// detected as changed
+		return hostname
+	}
+	for _, line := range h.lines {
+		copied := &hostLine{raw: line.raw, kind: line.kind, snapshot: line.snapshot}
+		for _, hostname := range line.hostnames {
+			copied.hostnames = append(copied.hostnames, copyOf(hostname))
+		}
+		clone.lines = append(clone.lines, copied)
+	}
+	if h.superseded != nil {
+		clone.superseded = make(map[*Hostname]*Hostname, len(h.superseded))
+		for hostname, winner := range h.superseded {
+			clone.superseded[copyOf(hostname)] = copyOf(winner)
+		}
+	}
+	return clone
 }
 
 // GetData returns the internal snapshot of the HostFile we read when we loaded
 // this HostFile from disk (if we ever did that). This is implemented for
-// testing and you probably won't need to use it.
+// testing and you probably won't need to use it. It is nil for a HostFile
+// read with ParseHostFile.
 func (h *HostFile) GetData() []byte {
 	return h.data
 }
@@ -83,5 +358,217 @@ func (h *HostFile) GetData() []byte {
 // 3. 127.* appears at the top of the list (so boot resolvers don't break)
 // 4. When present, localhost will always appear first in the domain list
 func (h *HostFile) Format(goos string) []byte {
-	return h.Hosts.Format(goos)
+	return h.format(goos, true)
+}
+
+// WriteTo writes the HostFile formatted for the current OS to w, see Format.
+// It implements io.WriterTo, the output is streamed instead of being built
+// in memory first.
+func (h *HostFile) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	out := bufio.NewWriter(counter)
+	h.writeFormat(out, runtime.GOOS, true)
+	err := out.Flush()
+	return counter.n, err
+}
+
+// MarshalText implements encoding.TextMarshaler, it returns the HostFile
+// formatted for the current OS.
+func (h *HostFile) MarshalText() ([]byte, error) {
+	return h.Format(runtime.GOOS), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It replaces the Hosts
+// with those parsed from text using the ParseOptions of the HostFile, the
+// zero ParseOptions for a new HostFile, and fails like
+// NewHostFileWithOptions.
+func (h *HostFile) UnmarshalText(text []byte) error {
+	parsed := &HostFile{Hosts: HostList{}, opts: h.opts}
+	if err := parsed.readFrom(bytes.NewReader(text)); err != nil {
+		return err
+	}
+	*h = *parsed
+	return nil
+}
+
+// countingWriter counts the bytes written to w for WriteTo.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// format renders the HostFile, ephemeral controls whether Hostnames marked
+// as Ephemeral are included.
+func (h *HostFile) format(goos string, ephemeral bool) []byte {
+	out := bytes.Buffer{}
+	h.writeFormat(&out, goos, ephemeral)
+	return out.Bytes()
+}
+
+// writeFormat writes the output of format to out. Write errors are left to
+// out, e.g. a bufio.Writer keeps the first one.
+func (h *HostFile) writeFormat(out io.StringWriter, goos string, ephemeral bool) {
+	present := make(map[*Hostname]bool, len(h.Hosts))
+	hosts := HostList{}
+	for _, hostname := range h.Hosts {
+		if ephemeral || !hostname.Ephemeral {
+			present[hostname] = true
+			hosts = append(hosts, hostname)
+		}
+	}
+	if !h.opts.Preserve {
+		hosts.writeFormat(out, goos)
+		return
+	}
+
+	// Hostnames which are not part of any line were added after parsing
+	assigned := make(map[*Hostname]bool)
+	for _, line := range h.lines {
+		for _, hostname := range line.hostnames {
+			if present[hostname] {
+				assigned[hostname] = true
+			}
+		}
+	}
+	added := HostList{}
+	for _, hostname := range hosts {
+		if !assigned[hostname] {
+			added = append(added, hostname)
+		}
+	}
+	// an added Hostname of the same domain and IP version as one removed from
+	// a line replaced it, e.g. Add with a new address, and takes its place in
+	// that line instead of being appended
+	replaced := h.replacedHostnames(present, added)
+	if len(replaced) > 0 {
+		remaining := HostList{}
+		used := make(map[*Hostname]bool, len(replaced))
+		for _, hostname := range replaced {
+			used[hostname] = true
+		}
+		for _, hostname := range added {
+			if !used[hostname] {
+				remaining = append(remaining, hostname)
+			}
+		}
+		added = remaining
+	}
+
+	// the lines are joined with "\n", the last one is held back since a
+	// final empty line is dropped in favour of the added entries
+	var last string
+	pending := false
+	write := func(line string) {
+		if pending {
+			out.WriteString(last)
+			out.WriteString("\n")
+		}
+		last, pending = line, true
+	}
+	for _, line := range h.lines {
+		if line.kind != lineEntry || !h.lineChanged(line, present) {
+			write(line.raw)
+			continue
+		}
+		for _, l := range formatLine(line, present, replaced, goos) {
+			write(l)
+		}
+	}
+
+	if len(added) == 0 {
+		if pending {
+			out.WriteString(last)
+		}
+		return
+	}
+	// keep the final newline of the file after the new entries
+	if pending && last != "" {
+		out.WriteString(last)
+		out.WriteString("\n")
+	}
+	added.writeFormat(out, goos)
+}
+
+// replacedHostnames maps the Hostnames removed from the lines to the added
+// Hostnames of the same domain and IP version which replace them, in the
+// order of the lines.
+func (h *HostFile) replacedHostnames(present map[*Hostname]bool, added HostList) map[*Hostname]*Hostname {
+	candidates := make(map[domainKey][]*Hostname)
+	for _, hostname := range added {
+		if !hostname.Ephemeral {
+			key := keyOf(hostname)
+			candidates[key] = append(candidates[key], hostname)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	replaced := make(map[*Hostname]*Hostname)
+	for _, line := range h.lines {
+		for _, hostname := range line.hostnames {
+			if present[hostname] {
+				continue
+			}
+			if h.winnerOf(hostname, present) != nil {
+				continue
+			}
+			key := keyOf(hostname)
+			if c := candidates[key]; len(c) > 0 {
+				replaced[hostname] = c[0]
+				candidates[key] = c[1:]
+			}
+		}
+	}
+	return replaced
+}
+
+// formatLine rewrites a changed entry line from the remaining Hostnames of
+// the line, keeping their order and trailing comments. Removed Hostnames
+// found in replaced are written as their replacement.
+func formatLine(line *hostLine, present map[*Hostname]bool, replaced map[*Hostname]*Hostname, goos string) []string {
+	var out []string
+	var group []string
+	var groupIP, groupComment string
+	var groupEnabled, groupWildcard bool
+	flush := func() {
+		if len(group) == 0 {
+			return
+		}
+		l := groupIP + " " + strings.Join(group, " ")
+		switch {
+		case !groupEnabled:
+			l = "# " + l
+		case groupWildcard:
+			l = wildcardMarker + l
+		}
+		if groupComment != "" {
+			l += " # " + groupComment
+		}
+		out = append(out, l)
+		group = nil
+	}
+	for _, hostname := range line.hostnames {
+		if replacement := replaced[hostname]; replacement != nil {
+			hostname = replacement
+		} else if !present[hostname] {
+			continue
+		}
+		ip := hostname.IPString()
+		comment := hostname.FormatComment()
+		wildcard := hostname.IsWildcard()
+		if goos == "windows" || ip != groupIP || hostname.Enabled != groupEnabled || comment != groupComment ||
+			wildcard != groupWildcard {
+			flush()
+		}
+		groupIP, groupEnabled, groupComment, groupWildcard = ip, hostname.Enabled, comment, wildcard
+		group = append(group, hostname.Domain)
+	}
+	flush()
+	return out
 }
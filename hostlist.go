@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sort"
 	"strings"
@@ -15,11 +16,17 @@ import (
 var ErrInvalidVersionArg = errors.New("version argument must be 4 or 6")
 var ErrHostnameNotFound = errors.New("hostname not found")
 
+// ErrDuplicateHostname and ErrConflictingHostname are wrapped by the errors
+// returned from HostList.Add.
+var ErrDuplicateHostname = errors.New("duplicate hostname entry")
+var ErrConflictingHostname = errors.New("conflicting hostname entries")
+
 // HostList is a sortable set of Hostnames. When in a HostList, Hostnames must
 // follow some rules:
 //
 // 	- HostList may contain IPv4 AND IPv6 ("IP version" or "IPv") Hostnames.
-// 	- Names are only allowed to overlap if IP version is different.
+// 	- Names are only allowed to overlap if IP version is different, unless
+// 	  they were added with AddAddress.
 // 	- Adding a Hostname for an existing name will replace the old one.
 //
 // The HostList uses a deterministic Sort order designed to make a HostFile
@@ -44,8 +51,8 @@ func (h HostList) Len() int {
 // sort it more easily. Note that we don't actually want to change the value,
 // so we use value copies here (not pointers).
 func MakeSurrogateIP(IP net.IP) net.IP {
-	if len(IP.String()) > 3 && IP.String()[0:3] == "127" {
-		return net.ParseIP("0" + IP.String()[3:])
+	if ip4 := IP.To4(); ip4 != nil && ip4[0] == 127 {
+		return net.IPv4(0, ip4[1], ip4[2], ip4[3])
 	}
 	return IP
 }
@@ -63,10 +70,10 @@ func (h HostList) Less(A, B int) bool {
 	}
 
 	// Sort "localhost" at the top
-	if h[A].Domain == "localhost" {
+	if strings.EqualFold(h[A].Domain, "localhost") {
 		return true
 	}
-	if h[B].Domain == "localhost" {
+	if strings.EqualFold(h[B].Domain, "localhost") {
 		return false
 	}
 
@@ -89,36 +96,10 @@ func (h HostList) Less(A, B int) bool {
 		// to the domain sorting section.
 	}
 
-	// Prep for sorting by domain name
-	aLength := len(h[A].Domain)
-	bLength := len(h[B].Domain)
-	max := aLength
-	if bLength > max {
-		max = bLength
-	}
-
-	// Sort domains alphabetically
-	// TODO: This works best if domains are lowercased. However, we do not
-	// enforce lowercase because of UTF-8 domain names, which may be broken by
-	// case folding. There is a way to do this correctly but it's complicated
-	// so I'm not going to do it right now.
-	for charIndex := 0; charIndex < max; charIndex++ {
-		// This index is longer than A, so A is shorter. A wins!
-		if charIndex >= aLength {
-			return true
-		}
-		// This index is longer than B, so B is shorter. A loses!
-		if charIndex >= bLength {
-			return false
-		}
-		// A and B differ at this index and A is less. A wins!
-		if h[A].Domain[charIndex] < h[B].Domain[charIndex] {
-			return true
-		}
-		// A and B differ at this index and B is less. A loses!
-		if h[A].Domain[charIndex] > h[B].Domain[charIndex] {
-			return false
-		}
+	// Sort domains alphabetically. Domains are stored as ASCII (punycode),
+	// so case folding them is safe.
+	if c := compareDomains(h[A].Domain, h[B].Domain); c != 0 {
+		return c < 0
 	}
 
 	// If we got here then A and B are the same -- by definition A is not Less
@@ -152,10 +133,12 @@ func (h *HostList) Contains(b *Hostname) bool {
 	return false
 }
 
-// ContainsDomain returns true if a Hostname in this HostList matches domain
+// ContainsDomain returns true if a Hostname in this HostList matches domain,
+// ignoring case.
 func (h *HostList) ContainsDomain(domain string) bool {
+	domain = canonicalDomain(domain)
 	for _, hostname := range *h {
-		if hostname.Domain == domain {
+		if strings.EqualFold(hostname.Domain, domain) {
 			return true
 		}
 	}
@@ -174,37 +157,126 @@ func (h *HostList) ContainsIP(IP net.IP) bool {
 
 // Add a new Hostname to this HostList. Add uses some merging logic in the
 // event it finds duplicated hostnames. In the case of a conflict (incompatible
-// entries) the last write wins. In the case of duplicates, duplicates will be
+// entries) the last write wins, replacing all addresses of the domain added
+// with AddAddress. In the case of duplicates, duplicates will be
 // removed and the remaining entry will be enabled if any of the duplicates was
-// enabled.
+// enabled. A zone-scoped IPv6 address like fe80::1%lo0 only conflicts with
+// entries of the same zone, so it can be listed next to e.g. ::1.
 //
 // Both duplicate and conflicts return errors so you are aware of them, but you
 // don't necessarily need to do anything about the error.
 func (h *HostList) Add(input *Hostname) error {
-	newHostname, err := NewHostname(input.Domain, input.IP.String(), input.Enabled)
+	return h.add(input, false)
+}
+
+// AddAddress is the multi-address mode of Add: a Hostname for an existing
+// domain and IP version but a different address is added next to the
+// existing ones instead of replacing them, e.g. for round-robin entries of a
+// domain on several backends. Duplicates are merged as by Add.
+//
+// The other HostList methods operate on all addresses of a domain, e.g.
+// FilterByDomainV returns and RemoveDomainV removes the whole address set.
+func (h *HostList) AddAddress(input *Hostname) error {
+	return h.add(input, true)
+}
+
+func (h *HostList) add(input *Hostname, multi bool) error {
+	return h.addIndexed(input, multi, nil)
+}
+
+// hostIndex holds the positions of the Hostnames of a HostList by domain and
+// IP version, so adding many Hostnames doesn't scan the list for each one.
+type hostIndex map[domainKey][]int
+
+func newHostIndex(h HostList) hostIndex {
+	index := make(hostIndex, len(h))
+	index.rebuild(h)
+	return index
+}
+
+func (index hostIndex) rebuild(h HostList) {
+	for key := range index {
+		delete(index, key)
+	}
+	for i, hostname := range h {
+		key := keyOf(hostname)
+		index[key] = append(index[key], i)
+	}
+}
+
+// addIndexed is add looking up the Hostnames of the same domain and IP
+// version in index, which is kept up to date. A nil index scans the list.
+func (h *HostList) addIndexed(input *Hostname, multi bool, index hostIndex) error {
+	newHostname, err := NewHostname(input.Domain, input.IPString(), input.Enabled)
 	if err != nil {
 		return err
 	}
-	for index, found := range *h {
+	newHostname.copyAnnotations(input)
+	return h.insert(newHostname, multi, index)
+}
+
+// insert adds newHostname, which must have been created by NewHostname and
+// is taken over by the list, see addIndexed.
+func (h *HostList) insert(newHostname *Hostname, multi bool, index hostIndex) error {
+	key := keyOf(newHostname)
+	var positions []int
+	if index != nil {
+		positions = index[key]
+	} else {
+		for _, i := range h.IndicesOfDomainV(newHostname.Domain, key.version) {
+			if keyOf((*h)[i]) == key {
+				positions = append(positions, i)
+			}
+		}
+	}
+
+	for _, i := range positions {
+		found := (*h)[i]
 		if found.Equal(newHostname) {
 			// If either hostname is enabled we will set the existing one to
 			// enabled state. That way if we add a hostname from the end of a
 			// hosts file it will take over, and if we later add a disabled one
 			// the original one will stick. We still error in this case so the
 			// user can see that there is a duplicate.
-			(*h)[index].Enabled = found.Enabled || newHostname.Enabled
-			return fmt.Errorf("duplicate hostname entry for %s -> %s",
-				newHostname.Domain, newHostname.IP)
-		} else if found.Domain == newHostname.Domain && found.IPv6 == newHostname.IPv6 {
-			(*h)[index] = newHostname
-			return fmt.Errorf("conflicting hostname entries for %s -> %s and -> %s",
-				newHostname.Domain, newHostname.IP, found.IP)
+			found.Enabled = found.Enabled || newHostname.Enabled
+			if found.Comment == "" && len(found.Metadata) == 0 {
+				found.copyAnnotations(newHostname)
+			}
+			return fmt.Errorf("%w for %s -> %s", ErrDuplicateHostname,
+				newHostname.Domain, newHostname.IPString())
+		}
+	}
+	if len(positions) > 0 && !multi {
+		found := (*h)[positions[0]]
+		(*h)[positions[0]] = newHostname
+		// the new entry replaces the whole address set
+		for i := len(positions) - 1; i > 0; i-- {
+			h.Remove(positions[i])
+		}
+		if index != nil && len(positions) > 1 {
+			index.rebuild(*h)
 		}
+		return fmt.Errorf("%w for %s -> %s and -> %s", ErrConflictingHostname,
+			newHostname.Domain, newHostname.IPString(), found.IPString())
 	}
 	*h = append(*h, newHostname)
+	if index != nil {
+		index[key] = append(index[key], len(*h)-1)
+	}
 	return nil
 }
 
+// duplicateOf returns the index of the Hostname at positions which equals
+// hostname, or -1 if there is none.
+func (h HostList) duplicateOf(hostname *Hostname, positions []int) int {
+	for _, i := range positions {
+		if h[i].Equal(hostname) {
+			return i
+		}
+	}
+	return -1
+}
+
 // IndexOf will indicate the index of a Hostname in HostList, or -1 if it is
 // not found.
 func (h *HostList) IndexOf(host *Hostname) int {
@@ -217,21 +289,42 @@ func (h *HostList) IndexOf(host *Hostname) int {
 }
 
 // IndexOfDomainV will indicate the index of a Hostname in HostList that has
-// the same domain and IP version, or -1 if it is not found.
+// the same domain and IP version, or -1 if it is not found. If the domain
+// has several addresses (see AddAddress) the index of the first one is
+// returned.
 //
 // This function will panic if IP version is not 4 or 6.
 func (h *HostList) IndexOfDomainV(domain string, version int) int {
 	if version != 4 && version != 6 {
 		panic(ErrInvalidVersionArg)
 	}
+	domain = canonicalDomain(domain)
 	for index, hostname := range *h {
-		if hostname.Domain == domain && hostname.IPv6 == (version == 6) {
+		if strings.EqualFold(hostname.Domain, domain) && hostname.IPv6 == (version == 6) {
 			return index
 		}
 	}
 	return -1
 }
 
+// IndicesOfDomainV returns the indexes of all Hostnames in HostList that
+// have the same domain and IP version, in list order.
+//
+// This function will panic if IP version is not 4 or 6.
+func (h *HostList) IndicesOfDomainV(domain string, version int) []int {
+	if version != 4 && version != 6 {
+		panic(ErrInvalidVersionArg)
+	}
+	var indices []int
+	domain = canonicalDomain(domain)
+	for index, hostname := range *h {
+		if strings.EqualFold(hostname.Domain, domain) && hostname.IPv6 == (version == 6) {
+			indices = append(indices, index)
+		}
+	}
+	return indices
+}
+
 // Remove will delete the Hostname at the specified index. If index is out of
 // bounds (i.e. -1), Remove silently no-ops. Remove returns the number of items
 // removed (0 or 1).
@@ -249,47 +342,36 @@ func (h *HostList) RemoveDomain(domain string) int {
 	return h.RemoveDomainV(domain, 4) + h.RemoveDomainV(domain, 6)
 }
 
-// RemoveDomainV removes a Hostname entry matching the domain and IP version.
+// RemoveDomainV removes the Hostname entries matching the domain and IP
+// version, all addresses of the domain in multi-address mode. Returns the
+// number of entries removed.
 func (h *HostList) RemoveDomainV(domain string, version int) int {
-	return h.Remove(h.IndexOfDomainV(domain, version))
+	indices := h.IndicesOfDomainV(domain, version)
+	for i := len(indices) - 1; i >= 0; i-- {
+		h.Remove(indices[i])
+	}
+	return len(indices)
 }
 
 // Enable will change any Hostnames matching name to be enabled.
 func (h *HostList) Enable(name string) error {
-	for _, hostname := range *h {
-		if hostname.Domain == name {
-			hostname.Enabled = true
-			return nil
-		}
-	}
-	return ErrHostnameNotFound
+	return h.setEnabled(name, 0, true)
 }
 
-// EnableV will change a Hostname matching domain and IP version to be enabled.
+// EnableV will change the Hostnames matching domain and IP version to be
+// enabled.
 //
 // This function will panic if IP version is not 4 or 6.
 func (h *HostList) EnableV(domain string, version int) error {
 	if version != 4 && version != 6 {
 		return ErrInvalidVersionArg
 	}
-	for _, hostname := range *h {
-		if hostname.Domain == domain && hostname.IPv6 == (version == 6) {
-			hostname.Enabled = true
-			return nil
-		}
-	}
-	return ErrHostnameNotFound
+	return h.setEnabled(domain, version, true)
 }
 
 // Disable will change any Hostnames matching name to be disabled.
 func (h *HostList) Disable(name string) error {
-	for _, hostname := range *h {
-		if hostname.Domain == name {
-			hostname.Enabled = false
-			return nil
-		}
-	}
-	return ErrHostnameNotFound
+	return h.setEnabled(name, 0, false)
 }
 
 // DisableV will change any Hostnames matching domain and IP version to be disabled.
@@ -299,13 +381,24 @@ func (h *HostList) DisableV(domain string, version int) error {
 	if version != 4 && version != 6 {
 		return ErrInvalidVersionArg
 	}
+	return h.setEnabled(domain, version, false)
+}
+
+// setEnabled changes the state of all Hostnames of domain, of any IP version
+// if version is 0.
+func (h *HostList) setEnabled(domain string, version int, enabled bool) error {
+	found := false
+	domain = canonicalDomain(domain)
 	for _, hostname := range *h {
-		if hostname.Domain == domain && hostname.IPv6 == (version == 6) {
-			hostname.Enabled = false
-			return nil
+		if strings.EqualFold(hostname.Domain, domain) && (version == 0 || hostname.IPv6 == (version == 6)) {
+			hostname.Enabled = enabled
+			found = true
 		}
 	}
-	return ErrHostnameNotFound
+	if !found {
+		return ErrHostnameNotFound
+	}
+	return nil
 }
 
 // FilterByIP filters the list of hostnames by IP address.
@@ -318,10 +411,11 @@ func (h *HostList) FilterByIP(IP net.IP) (hostnames []*Hostname) {
 	return
 }
 
-// FilterByDomain filters the list of hostnames by Domain.
+// FilterByDomain filters the list of hostnames by Domain, ignoring case.
 func (h *HostList) FilterByDomain(domain string) (hostnames []*Hostname) {
+	domain = canonicalDomain(domain)
 	for _, hostname := range *h {
-		if hostname.Domain == domain {
+		if strings.EqualFold(hostname.Domain, domain) {
 			hostnames = append(hostnames, hostname)
 		}
 	}
@@ -329,22 +423,81 @@ func (h *HostList) FilterByDomain(domain string) (hostnames []*Hostname) {
 }
 
 // FilterByDomainV filters the list of hostnames by domain and IPv4 or IPv6.
-// This should never contain more than one item, but returns a list for
-// consistency with other filter functions.
+// This contains more than one item only for domains with several addresses,
+// see AddAddress.
 //
 // This function will panic if IP version is not 4 or 6.
 func (h *HostList) FilterByDomainV(domain string, version int) (hostnames []*Hostname) {
 	if version != 4 && version != 6 {
 		panic(ErrInvalidVersionArg)
 	}
+	domain = canonicalDomain(domain)
 	for _, hostname := range *h {
-		if hostname.Domain == domain && hostname.IPv6 == (version == 6) {
+		if strings.EqualFold(hostname.Domain, domain) && hostname.IPv6 == (version == 6) {
 			hostnames = append(hostnames, hostname)
 		}
 	}
 	return
 }
 
+// Resolve returns the addresses of the enabled Hostnames matching name, IPv4
+// before IPv6, or nil if there are none. Entries for name itself take
+// precedence over wildcards, otherwise the wildcard with the longest
+// matching suffix wins: "a.b.preview.internal" resolves through
+// "*.b.preview.internal" if it exists and through "*.preview.internal"
+// otherwise. A wildcard doesn't match its bare suffix, so
+// "*.preview.internal" doesn't match "preview.internal". Resolve scans the
+// list, use a Resolver for repeated lookups.
+func (h *HostList) Resolve(name string) []net.IP {
+	return resolvedIPs(h.resolve(name))
+}
+
+// LookupAddr returns the domains of the enabled Hostnames with address ip in
+// list order, wildcards are left out. Use a Resolver for repeated lookups.
+func (h *HostList) LookupAddr(ip net.IP) []string {
+	var hostnames []*Hostname
+	for _, hostname := range *h {
+		if hostname.IP.Equal(ip) {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	return lookupNames(hostnames)
+}
+
+// resolve returns the enabled Hostnames name resolves to, see Resolve.
+func (h *HostList) resolve(name string) []*Hostname {
+	name = canonicalDomain(strings.TrimSuffix(name, "."))
+	var exact, wildcards []*Hostname
+	longest := 0
+	for _, hostname := range *h {
+		if !hostname.Enabled {
+			continue
+		}
+		if !hostname.IsWildcard() {
+			if strings.EqualFold(hostname.Domain, name) {
+				exact = append(exact, hostname)
+			}
+			continue
+		}
+		// the suffix including the dot, e.g. ".preview.internal"
+		suffix := hostname.Domain[len(wildcardPrefix)-1:]
+		if len(name) <= len(suffix) || !strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+			continue
+		}
+		switch {
+		case len(suffix) > longest:
+			wildcards = []*Hostname{hostname}
+			longest = len(suffix)
+		case len(suffix) == longest:
+			wildcards = append(wildcards, hostname)
+		}
+	}
+	if len(exact) > 0 {
+		return exact
+	}
+	return wildcards
+}
+
 // GetUniqueIPs extracts an ordered list of unique IPs from the HostList.
 // This calls Sort() internally.
 func (h *HostList) GetUniqueIPs() []net.IP {
@@ -373,61 +526,121 @@ func (h *HostList) GetUniqueIPs() []net.IP {
 // 2. Commented items are sorted displayed
 // 3. 127.* appears at the top of the list (so boot resolvers don't break)
 // 4. When present, "localhost" will always appear first in the domain list
+// 5. Wildcard entries are commented out with a marker, see Hostname.Format
 func (h *HostList) FormatLinux() []byte {
-	h.Sort()
 	out := bytes.Buffer{}
+	h.writeLinux(&out)
+	return out.Bytes()
+}
+
+// writeLinux writes the output of FormatLinux to out. Write errors are left
+// to out, e.g. a bufio.Writer keeps the first one.
+func (h *HostList) writeLinux(out io.StringWriter) {
+	h.Sort()
 
-	// We want to output one line of hostnames per IP, so first we get that
-	// list of IPs and iterate.
-	for _, IP := range h.GetUniqueIPs() {
+	// We want to output one line of hostnames per address, so first we
+	// group the sorted hostnames by address. The zone and the notation of
+	// IPv4-mapped addresses are part of the address.
+	var addrs []string
+	byAddr := make(map[string][]*Hostname)
+	for _, hostname := range *h {
+		addr := hostname.IPString()
+		if _, ok := byAddr[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		byAddr[addr] = append(byAddr[addr], hostname)
+	}
+
+	for _, addr := range addrs {
 		// Technically if an IP has some disabled hostnames we'll show two
-		// lines, one starting with a comment (#).
-		var enabledIPs []string
-		var disabledIPs []string
+		// lines, one starting with a comment (#). Hostnames with different
+		// trailing comments need separate lines as well.
+		var enabledLines []*formatGroup
+		var disabledLines []*formatGroup
 
-		// For this IP, get all hostnames that match and iterate over them.
-		for _, hostname := range h.FilterByIP(IP) {
+		// For this address, get all hostnames that match and iterate over them.
+		for _, hostname := range byAddr[addr] {
 			// If it's enabled, put it in the enabled bucket (likewise for
 			// disabled hostnames)
 			if hostname.Enabled {
-				enabledIPs = append(enabledIPs, hostname.Domain)
+				enabledLines = addToGroup(enabledLines, hostname)
 			} else {
-				disabledIPs = append(disabledIPs, hostname.Domain)
+				disabledLines = addToGroup(disabledLines, hostname)
 			}
 		}
 
-		// Finally, if the bucket contains anything, concatenate it all
-		// together and append it to the output. Also add a newline.
-		if len(enabledIPs) > 0 {
-			out.WriteString(fmt.Sprintf("%s %s\n", IP.String(), strings.Join(enabledIPs, " ")))
+		// Finally, concatenate each bucket together and append it to the
+		// output. Also add a newline.
+		for _, group := range enabledLines {
+			out.WriteString(group.format(addr, ""))
+		}
+		for _, group := range disabledLines {
+			out.WriteString(group.format(addr, "# "))
 		}
+	}
+}
 
-		if len(disabledIPs) > 0 {
-			out.WriteString(fmt.Sprintf("# %s %s\n", IP.String(), strings.Join(disabledIPs, " ")))
+// formatGroup is a line of FormatLinux output: domains of the same IP that
+// share the enabled state and the trailing comment. Wildcards get lines of
+// their own.
+type formatGroup struct {
+	comment  string
+	wildcard bool
+	domains  []string
+}
+
+func addToGroup(groups []*formatGroup, hostname *Hostname) []*formatGroup {
+	comment := hostname.FormatComment()
+	wildcard := hostname.IsWildcard()
+	for _, group := range groups {
+		if group.comment == comment && group.wildcard == wildcard {
+			group.domains = append(group.domains, hostname.Domain)
+			return groups
 		}
 	}
+	return append(groups, &formatGroup{comment: comment, wildcard: wildcard, domains: []string{hostname.Domain}})
+}
 
-	return out.Bytes()
+func (g *formatGroup) format(addr string, prefix string) string {
+	if g.wildcard && prefix == "" {
+		prefix = wildcardMarker
+	}
+	line := fmt.Sprintf("%s%s %s", prefix, addr, strings.Join(g.domains, " "))
+	if g.comment != "" {
+		line += " # " + g.comment
+	}
+	return line + "\n"
 }
 
 func (h HostList) FormatWindows() []byte {
-	h.Sort()
 	out := bytes.Buffer{}
+	h.writeWindows(&out)
+	return out.Bytes()
+}
+
+// writeWindows writes the output of FormatWindows to out.
+func (h HostList) writeWindows(out io.StringWriter) {
+	h.Sort()
 
 	for _, hostname := range h {
 		out.WriteString(hostname.Format())
 		out.WriteString("\n")
 	}
+}
 
+func (h *HostList) Format(goos string) []byte {
+	out := bytes.Buffer{}
+	h.writeFormat(&out, goos)
 	return out.Bytes()
 }
 
-func (h *HostList) Format(goos string) []byte {
+// writeFormat writes the output of Format to out.
+func (h *HostList) writeFormat(out io.StringWriter, goos string) {
 	switch goos {
 	case "windows":
-		return h.FormatWindows()
+		h.writeWindows(out)
 	case "unix":
-		return h.FormatLinux()
+		h.writeLinux(out)
 	default:
 		// Theoretically the Windows format might be more compatible but there
 		// are a lot of different operating systems, and they're almost all
@@ -435,7 +648,7 @@ func (h *HostList) Format(goos string) []byte {
 		// example, FreeBSD, MacOS, and Linux all use the same format and while
 		// I haven't checked OpenBSD or NetBSD, I am going to assume they are
 		// OK with this format. If not we can add a case above.
-		return h.FormatLinux()
+		h.writeLinux(out)
 	}
 }
 
@@ -452,8 +665,9 @@ func (h *HostList) Apply(jsonbytes []byte) error {
 		return err
 	}
 
+	index := newHostIndex(*h)
 	for _, hostname := range hostnames {
-		_ = h.Add(hostname)
+		_ = h.addIndexed(hostname, false, index)
 	}
 
 	return nil
@@ -464,50 +678,18 @@ func (h *HostList) Apply(jsonbytes []byte) error {
 //
 //	127.0.0.1 localhost mysite1 mysite2
 func ParseLine(line string) (HostList, error) {
-	var hostnames HostList
-
 	if len(line) == 0 {
-		return hostnames, fmt.Errorf("line is blank")
-	}
-
-	// Parse leading # for disabled lines
-	enabled := true
-	if line[0:1] == "#" {
-		enabled = false
-		line = strings.TrimSpace(line[1:])
+		return nil, fmt.Errorf("line is blank")
 	}
 
-	// Parse other #s for actual comments
-	line = strings.Split(line, "#")[0]
-
-	// Replace tabs and multi spaces with single spaces throughout
-	line = strings.Replace(line, "\t", " ", -1)
-	for strings.Contains(line, "  ") {
-		line = strings.Replace(line, "  ", " ", -1)
-	}
-	line = strings.TrimSpace(line)
-
-	// Break line into words
-	words := strings.Split(line, " ")
-	for idx, word := range words {
-		words[idx] = strings.TrimSpace(word)
-	}
-
-	// Separate the first bit (the ip) from the other bits (the domains)
-	ip := words[0]
-	domains := words[1:]
-
-	// if LooksLikeIPv4(ip) || LooksLikeIPv6(ip) {
-	for _, v := range domains {
-		hostname, err := NewHostname(v, ip, enabled)
-		if err != nil {
-			return nil, err
+	parsed := parseLine(line, 1, DomainAny)
+	for _, err := range parsed.errs {
+		// a missing domain yields no hostnames, as before
+		if err.Kind != ParseErrMissingDomain {
+			return nil, err.Err
 		}
-		hostnames = append(hostnames, hostname)
 	}
-	// }
-
-	return hostnames, nil
+	return parsed.hostnames, nil
 }
 
 // MustParseLine is like ParseLine but panics instead of errors.
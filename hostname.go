@@ -1,28 +1,48 @@
 package etcdhosts_client
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
-	"regexp"
+	"sort"
 	"strings"
 )
 
-var ipv4Pattern = regexp.MustCompile(`^(?:[0-9]{1,3}\.){3}[0-9]{1,3}$`)
-var ipv6Pattern = regexp.MustCompile(`^[(a-fA-F0-9){1-4}:]+$`)
-
-// LooksLikeIPv4 returns true if the IP looks like it's IPv4. This does not
-// validate whether the string is a valid IP address.
+// LooksLikeIPv4 returns true if ip is a valid IPv4 address in dotted decimal
+// notation.
 func LooksLikeIPv4(ip string) bool {
-	return ipv4Pattern.MatchString(ip)
+	_, _, ipv6, err := parseAddr(ip)
+	return err == nil && !ipv6
 }
 
-// LooksLikeIPv6 returns true if the IP looks like it's IPv6. This does not
-// validate whether the string is a valid IP address.
+// LooksLikeIPv6 returns true if ip is a valid IPv6 address, optionally with
+// a zone like fe80::1%lo0. IPv4-mapped addresses like ::ffff:10.0.0.1 are
+// IPv6 addresses.
 func LooksLikeIPv6(ip string) bool {
-	if !strings.Contains(ip, ":") {
-		return false
+	_, _, ipv6, err := parseAddr(ip)
+	return err == nil && ipv6
+}
+
+// parseAddr parses an IPv4 or IPv6 address with an optional IPv6 zone. The
+// family is that of the notation, so ::ffff:10.0.0.1 is IPv6 although
+// net.IP treats it like 10.0.0.1.
+func parseAddr(s string) (ip net.IP, zone string, ipv6 bool, err error) {
+	addr := s
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		addr, zone = s[:i], s[i+1:]
+		if zone == "" {
+			return nil, "", false, fmt.Errorf("unable to parse IP address %q: empty zone", s)
+		}
 	}
-	return ipv6Pattern.MatchString(ip)
+	ip = net.ParseIP(addr)
+	if ip == nil {
+		return nil, "", false, fmt.Errorf("unable to parse IP address %q", s)
+	}
+	ipv6 = strings.Contains(addr, ":")
+	if zone != "" && !ipv6 {
+		return nil, "", false, fmt.Errorf("unable to parse IP address %q: zone on IPv4 address", s)
+	}
+	return ip, zone, ipv6, nil
 }
 
 // Hostname represents a hosts file entry, including a Domain, IP, whether the
@@ -37,16 +57,37 @@ type Hostname struct {
 	IP      net.IP `json:"ip"`
 	Enabled bool   `json:"enabled"`
 	IPv6    bool   `json:"-"`
+	// Zone is the IPv6 zone of a link-local address, e.g. "lo0" for
+	// fe80::1%lo0. It is part of "ip" in JSON.
+	Zone string `json:"-"`
+	// Comment is the trailing "# ..." comment of the entry, without the "#".
+	Comment string `json:"comment,omitempty"`
+	// Metadata holds the key=value pairs found in Comment, e.g. owner or
+	// ticket annotations. Pairs which are not part of Comment are appended
+	// to it when the Hostname is formatted.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Ephemeral is set on entries merged from lease backed registrations,
+	// they are never written back to the hosts key.
+	Ephemeral bool `json:"-"`
 }
 
 // NewHostname creates a new Hostname struct and automatically sets the IPv6
-// field based on the IP you pass in.
+// field based on the IP you pass in. Unicode domains are stored in their
+// punycode form, and domain must pass ValidateDomain with DomainAny.
 func NewHostname(domain, ip string, enabled bool) (*Hostname, error) {
-	if !LooksLikeIPv4(ip) && !LooksLikeIPv6(ip) {
-		return nil, fmt.Errorf("unable to parse IP address %q", ip)
+	IP, zone, ipv6, err := parseAddr(ip)
+	if err != nil {
+		return nil, err
 	}
-	IP := net.ParseIP(ip)
-	return &Hostname{domain, IP, enabled, LooksLikeIPv6(ip)}, nil
+	domain, err = ToASCIIDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	err = ValidateDomain(domain, DomainAny)
+	if err != nil {
+		return nil, err
+	}
+	return &Hostname{Domain: domain, IP: IP, Enabled: enabled, IPv6: ipv6, Zone: zone}, nil
 }
 
 // MustHostname calls NewHostname but panics if there is an error parsing it.
@@ -58,34 +99,164 @@ func MustHostname(domain, ip string, enabled bool) *Hostname {
 	return hostname
 }
 
-// Equal compares two Hostnames. Note that only the Domain and IP fields are
-// compared because Enabled is transient state, and IPv6 should be set
-// automatically based on IP.
+// Equal compares two Hostnames. Note that only the Domain and the address
+// are compared because Enabled is transient state. Domains are compared
+// case-insensitively, and 10.0.0.1 and ::ffff:10.0.0.1 are different
+// addresses since they differ in family.
 func (h *Hostname) Equal(n *Hostname) bool {
-	return h.Domain == n.Domain && h.IP.Equal(n.IP)
+	return strings.EqualFold(h.Domain, n.Domain) && h.EqualAddr(n)
 }
 
-// EqualIP compares an IP against this Hostname.
+// EqualAddr reports whether both Hostnames have the same IP, family and zone.
+func (h *Hostname) EqualAddr(n *Hostname) bool {
+	return h.IPv6 == n.IPv6 && h.IP.Equal(n.IP) && h.Zone == n.Zone
+}
+
+// EqualIP compares an IP against this Hostname, ignoring family and zone.
 func (h *Hostname) EqualIP(ip net.IP) bool {
 	return h.IP.Equal(ip)
 }
 
+// IPString formats the address of the Hostname including its zone. IPv6
+// Hostnames keep their notation for IPv4-mapped addresses, e.g.
+// ::ffff:10.0.0.1.
+func (h *Hostname) IPString() string {
+	ip := h.IP.String()
+	if h.IPv6 && h.IP.To4() != nil {
+		ip = "::ffff:" + h.IP.To4().String()
+	}
+	if h.Zone != "" {
+		ip += "%" + h.Zone
+	}
+	return ip
+}
+
+// MarshalJSON writes the address as "ip" using IPString, so the zone and the
+// family of IPv4-mapped addresses survive a round trip.
+func (h Hostname) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Domain   string            `json:"domain"`
+		IP       string            `json:"ip"`
+		Enabled  bool              `json:"enabled"`
+		Comment  string            `json:"comment,omitempty"`
+		Metadata map[string]string `json:"metadata,omitempty"`
+	}{h.Domain, h.IPString(), h.Enabled, h.Comment, h.Metadata})
+}
+
+// UnmarshalJSON is the counterpart of MarshalJSON, it sets IPv6 and Zone
+// from "ip".
+func (h *Hostname) UnmarshalJSON(data []byte) error {
+	type alias Hostname
+	aux := struct {
+		*alias
+		IP string `json:"ip"`
+	}{alias: (*alias)(h)}
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+	h.IP, h.Zone, h.IPv6 = nil, "", false
+	if aux.IP == "" {
+		return nil
+	}
+	h.IP, h.Zone, h.IPv6, err = parseAddr(aux.IP)
+	return err
+}
+
 // IsValid does a spot-check on the domain and IP to make sure they aren't blank
 func (h *Hostname) IsValid() bool {
 	return h.Domain != "" && h.IP != nil
 }
 
+// wildcardMarker starts the line of an enabled wildcard entry. Resolvers
+// don't support wildcards, so the line is a comment for them, while Parse
+// reads it back as an enabled entry.
+const wildcardMarker = "# etcdhosts: wildcard "
+
+// IsWildcard reports whether the Domain is a wildcard pattern like
+// "*.preview.internal", see HostList.Resolve.
+func (h *Hostname) IsWildcard() bool {
+	return IsWildcardDomain(h.Domain)
+}
+
 // Format outputs the Hostname as you'd see it in a hosts file, with a comment
-// if it is disabled. E.g.
-// # 127.0.0.1 blah.example.com
+// if it is disabled and its trailing comment if any. E.g.
+// # 127.0.0.1 blah.example.com # owner=ops
+// Enabled wildcard entries are commented out with a marker, e.g.
+// # etcdhosts: wildcard 10.2.0.5 *.preview.internal
 func (h *Hostname) Format() string {
-	r := fmt.Sprintf("%s %s", h.IP.String(), h.Domain)
-	if !h.Enabled {
+	r := fmt.Sprintf("%s %s", h.IPString(), h.Domain)
+	switch {
+	case !h.Enabled:
 		r = "# " + r
+	case h.IsWildcard():
+		r = wildcardMarker + r
+	}
+	if comment := h.FormatComment(); comment != "" {
+		r += " # " + comment
 	}
 	return r
 }
 
+// FormatComment returns the trailing comment of the Hostname without the
+// "#": Comment followed by the Metadata pairs missing from it, sorted by key.
+func (h *Hostname) FormatComment() string {
+	parsed := ParseMetadata(h.Comment)
+	var keys []string
+	for key, value := range h.Metadata {
+		if v, ok := parsed[key]; !ok || v != value {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	if h.Comment != "" {
+		parts = append(parts, h.Comment)
+	}
+	for _, key := range keys {
+		parts = append(parts, key+"="+h.Metadata[key])
+	}
+	return strings.Join(parts, " ")
+}
+
+// SetComment sets Comment and replaces Metadata with the key=value pairs
+// found in comment.
+func (h *Hostname) SetComment(comment string) {
+	h.Comment = strings.TrimSpace(comment)
+	h.Metadata = ParseMetadata(h.Comment)
+}
+
+// ParseMetadata extracts the whitespace separated key=value pairs of a
+// comment, e.g. "owner=ops ticket=OPS-12 legacy box". It returns nil if there
+// are none.
+func ParseMetadata(comment string) map[string]string {
+	var metadata map[string]string
+	for _, word := range strings.Fields(comment) {
+		index := strings.Index(word, "=")
+		if index < 1 {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[word[:index]] = word[index+1:]
+	}
+	return metadata
+}
+
+// copyAnnotations copies Comment and Metadata from src to h.
+func (h *Hostname) copyAnnotations(src *Hostname) {
+	h.Comment = src.Comment
+	h.Metadata = nil
+	for key, value := range src.Metadata {
+		if h.Metadata == nil {
+			h.Metadata = make(map[string]string, len(src.Metadata))
+		}
+		h.Metadata[key] = value
+	}
+}
+
 // FormatEnabled displays Hostname.Enabled as (On) or (Off)
 func (h *Hostname) FormatEnabled() string {
 	if h.Enabled {
@@ -94,8 +265,9 @@ func (h *Hostname) FormatEnabled() string {
 	return "(Off)"
 }
 
-// FormatHuman outputs the Hostname in a more human-readable format:
+// FormatHuman outputs the Hostname in a more human-readable format, with
+// punycode domains shown in Unicode:
 // blah.example.com -> 127.0.0.1 (Off)
 func (h *Hostname) FormatHuman() string {
-	return fmt.Sprintf("%s -> %s %s", h.Domain, h.IP, h.FormatEnabled())
+	return fmt.Sprintf("%s -> %s %s", ToUnicodeDomain(h.Domain), h.IPString(), h.FormatEnabled())
 }
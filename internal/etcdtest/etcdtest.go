@@ -0,0 +1,69 @@
+// Package etcdtest runs single node etcd servers for the tests of the
+// client, the command line tool and the DNS server.
+package etcdtest
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/embed"
+)
+
+// Start starts a single node etcd on free local ports, configured by
+// configure if given, and returns its client endpoint.
+func Start(t *testing.T, configure func(*embed.Config)) string {
+	cfg := Config(t)
+	if configure != nil {
+		configure(cfg)
+	}
+	Run(t, cfg)
+	return cfg.ACUrls[0].String()
+}
+
+// Config returns the config of a single node etcd on free local ports, its
+// data dir is removed at the end of the test.
+func Config(t *testing.T) *embed.Config {
+	dir, err := ioutil.TempDir("", "etcdhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.Logger = "zap"
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	return cfg
+}
+
+// Run starts etcd with cfg, it is closed at the end of the test unless the
+// test closes it before.
+func Run(t *testing.T, cfg *embed.Config) *embed.Etcd {
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("etcd did not start")
+	}
+	return e
+}
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
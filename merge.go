@@ -0,0 +1,232 @@
+package etcdhosts_client
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Conflict is an entry that was changed differently by both sides of a Merge.
+// Base, Ours or Theirs is nil if the entry did not exist on that side.
+type Conflict struct {
+	Domain  string
+	Version int
+	Base    *Hostname
+	Ours    *Hostname
+	Theirs  *Hostname
+}
+
+// String formats the Conflict for humans, e.g.
+// "baidu.com (IPv4): base 1.1.1.1 (On), ours 2.2.2.2 (On), theirs 3.3.3.3 (On)".
+func (c Conflict) String() string {
+	side := func(hostname *Hostname) string {
+		if hostname == nil {
+			return "<none>"
+		}
+		return fmt.Sprintf("%s %s", hostname.IPString(), hostname.FormatEnabled())
+	}
+	return fmt.Sprintf("%s (IPv%d): base %s, ours %s, theirs %s",
+		c.Domain, c.Version, side(c.Base), side(c.Ours), side(c.Theirs))
+}
+
+// Merge combines the changes ours and theirs made to base. Entries are
+// matched by domain and IP version: a change made by only one side is taken
+// over, changes made identically by both sides are taken once. If both sides
+// changed the IP or enabled state of an entry differently, or one side
+// removed an entry the other changed, the entry is reported as a Conflict and
+// the merged HostFile keeps ours. Differences only in the comment of an entry
+// also keep ours but are not reported, and if one side only changed the
+// comment the IP and enabled state of the other side are taken together
+// with the comment of ours.
+//
+// The result is built on a copy of theirs, so the layout of theirs is kept
+// if it was parsed with ParseOptions.Preserve. Conflicts are sorted by domain
+// and IP version.
+func Merge(base, ours, theirs *HostFile) (*HostFile, []Conflict) {
+	baseIndex, ourIndex, theirIndex := indexDomainV(base), indexDomainV(ours), indexDomainV(theirs)
+
+	keys := make(map[domainKey]bool)
+	for _, index := range []map[domainKey][]*Hostname{baseIndex, ourIndex, theirIndex} {
+		for key := range index {
+			keys[key] = true
+		}
+	}
+
+	var merged *HostFile
+	if theirs != nil {
+		merged = theirs.Clone()
+	} else {
+		merged = &HostFile{Hosts: HostList{}}
+	}
+
+	var conflicts []Conflict
+	for key := range keys {
+		baseEntries, ourEntries, theirEntries := baseIndex[key], ourIndex[key], theirIndex[key]
+		if len(baseEntries) > 1 || len(ourEntries) > 1 || len(theirEntries) > 1 {
+			conflicts = append(conflicts, mergeAddresses(&merged.Hosts, key, baseEntries, ourEntries, theirEntries)...)
+			continue
+		}
+		b, o, t := first(baseEntries), first(ourEntries), first(theirEntries)
+		desired, changed, conflict := mergeEntry(b, o, t)
+		if conflict {
+			conflicts = append(conflicts, newConflict(key, b, o, t))
+		}
+		if changed {
+			setEntry(&merged.Hosts, key, desired)
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		if c := compareDomains(conflicts[i].Domain, conflicts[j].Domain); c != 0 {
+			return c < 0
+		}
+		if conflicts[i].Version != conflicts[j].Version {
+			return conflicts[i].Version < conflicts[j].Version
+		}
+		return conflicts[i].address() < conflicts[j].address()
+	})
+	return merged, conflicts
+}
+
+// newConflict creates a Conflict of k, its domain is taken as written from
+// the first side having the entry, see newChange.
+func newConflict(k domainKey, b, o, t *Hostname) Conflict {
+	domain := k.domain
+	for _, hostname := range []*Hostname{o, t, b} {
+		if hostname != nil {
+			domain = hostname.Domain
+			break
+		}
+	}
+	return Conflict{Domain: domain, Version: k.version, Base: b, Ours: o, Theirs: t}
+}
+
+// mergeEntry decides the merged state of an entry, changed is false if
+// theirs can be kept as is.
+func mergeEntry(b, o, t *Hostname) (desired *Hostname, changed bool, conflict bool) {
+	switch {
+	case sameEntry(o, t, true):
+		return nil, false, false
+	case sameEntry(o, b, true):
+		return nil, false, false
+	case sameEntry(t, b, true):
+		return o, true, false
+	case sameEntry(o, t, false):
+		return o, true, false
+	case o != nil && t != nil && sameEntry(o, b, false):
+		// ours only changed the comment
+		desired = cloneHostname(t)
+		desired.copyAnnotations(o)
+		return desired, true, false
+	case o != nil && t != nil && sameEntry(t, b, false):
+		// theirs only changed the comment
+		return o, true, false
+	}
+	return o, true, true
+}
+
+// mergeAddresses merges the address sets of a domain and IP version address
+// by address into hosts.
+func mergeAddresses(hosts *HostList, key domainKey, base, ours, theirs []*Hostname) []Conflict {
+	baseByAddr, ourByAddr, theirByAddr := byAddress(base), byAddress(ours), byAddress(theirs)
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, hostnames := range [][]*Hostname{base, ours, theirs} {
+		for _, hostname := range hostnames {
+			if addr := hostname.IPString(); !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	var conflicts []Conflict
+	for _, addr := range addrs {
+		b, o, t := baseByAddr[addr], ourByAddr[addr], theirByAddr[addr]
+		desired, changed, conflict := mergeEntry(b, o, t)
+		if conflict {
+			conflicts = append(conflicts, newConflict(key, b, o, t))
+		}
+		if changed {
+			setAddress(hosts, key, addr, desired)
+		}
+	}
+	return conflicts
+}
+
+func first(hostnames []*Hostname) *Hostname {
+	if len(hostnames) == 0 {
+		return nil
+	}
+	return hostnames[0]
+}
+
+// address returns the address the Conflict is about, used to order conflicts
+// of the same domain.
+func (c Conflict) address() string {
+	for _, hostname := range []*Hostname{c.Ours, c.Theirs, c.Base} {
+		if hostname != nil {
+			return hostname.IPString()
+		}
+	}
+	return ""
+}
+
+// sameEntry compares the state of two entries of the same domain and IP
+// version, nil stands for a missing entry.
+func sameEntry(a, b *Hostname, comment bool) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if comment && a.FormatComment() != b.FormatComment() {
+		return false
+	}
+	return a.EqualAddr(b) && a.Enabled == b.Enabled
+}
+
+// setAddress makes the entry of key with address addr in hosts match
+// desired, removing it if desired is nil.
+func setAddress(hosts *HostList, key domainKey, addr string, desired *Hostname) {
+	index := -1
+	for i, hostname := range *hosts {
+		if keyOf(hostname) == key && hostname.IPString() == addr {
+			index = i
+			break
+		}
+	}
+	switch {
+	case desired == nil:
+		hosts.Remove(index)
+	case index < 0:
+		_ = hosts.AddAddress(desired)
+	default:
+		found := (*hosts)[index]
+		found.Enabled = desired.Enabled
+		found.copyAnnotations(desired)
+	}
+}
+
+// setEntry makes the entry of key in hosts match desired, removing it if
+// desired is nil. Existing entries are changed in place so they keep their
+// position.
+func setEntry(hosts *HostList, key domainKey, desired *Hostname) {
+	index := -1
+	for i, hostname := range *hosts {
+		if keyOf(hostname) == key {
+			index = i
+			break
+		}
+	}
+	switch {
+	case desired == nil:
+		hosts.Remove(index)
+	case index < 0:
+		_ = hosts.Add(desired)
+	default:
+		found := (*hosts)[index]
+		found.IP = append(net.IP(nil), desired.IP...)
+		found.Zone = desired.Zone
+		found.Enabled = desired.Enabled
+		found.copyAnnotations(desired)
+	}
+}
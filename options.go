@@ -0,0 +1,198 @@
+package etcdhosts_client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ClientOption configures a HostsClient created by NewClientWithOptions.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	ca   string
+	cert string
+	key  string
+
+	insecureSkipVerify bool
+
+	username string
+	password string
+
+	dialTimeout      time.Duration
+	requestTimeout   time.Duration
+	keepAliveTime    time.Duration
+	keepAliveTimeout time.Duration
+
+	maxSendMsgSize int
+	maxRecvMsgSize int
+
+	layout       StorageLayout
+	multiAddress bool
+
+	cachePath string
+}
+
+func defaultClientOptions() *clientOptions {
+	return &clientOptions{
+		dialTimeout:    5 * time.Second,
+		requestTimeout: 3 * time.Second,
+	}
+}
+
+// WithTLS enables mutual TLS. ca, cert and key may be either file paths
+// (a leading "~" is expanded to the home dir) or base64 encoded PEM data.
+func WithTLS(ca, cert, key string) ClientOption {
+	return func(o *clientOptions) {
+		o.ca = ca
+		o.cert = cert
+		o.key = key
+	}
+}
+
+// WithCA enables TLS which only verifies the server against ca, no client
+// certificate is presented. ca may be a file path or base64 encoded PEM data.
+func WithCA(ca string) ClientOption {
+	return func(o *clientOptions) {
+		o.ca = ca
+	}
+}
+
+// WithInsecureSkipVerify enables TLS without verifying the server
+// certificate. This should only be used for testing.
+func WithInsecureSkipVerify() ClientOption {
+	return func(o *clientOptions) {
+		o.insecureSkipVerify = true
+	}
+}
+
+// WithAuth sets the etcd user and password used for RBAC authentication.
+func WithAuth(username, password string) ClientOption {
+	return func(o *clientOptions) {
+		o.username = username
+		o.password = password
+	}
+}
+
+// WithDialTimeout sets the timeout for establishing the connection, the
+// default is 5s.
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.dialTimeout = timeout
+	}
+}
+
+// WithRequestTimeout sets the timeout used by the methods which don't take a
+// context, the default is 3s.
+func WithRequestTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.requestTimeout = timeout
+	}
+}
+
+// WithKeepAlive sets the interval of client keepalive pings and how long to
+// wait for the response before closing the connection.
+func WithKeepAlive(interval, timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.keepAliveTime = interval
+		o.keepAliveTimeout = timeout
+	}
+}
+
+// WithMaxMsgSize sets the maximum size in bytes of the request and response
+// messages, 0 keeps the etcd client defaults.
+func WithMaxMsgSize(send, recv int) ClientOption {
+	return func(o *clientOptions) {
+		o.maxSendMsgSize = send
+		o.maxRecvMsgSize = recv
+	}
+}
+
+// WithMultiAddress keeps every address of a domain and IP version when the
+// hosts are read, see HostList.AddAddress. Without it the last entry of a
+// domain wins.
+func WithMultiAddress() ClientOption {
+	return func(o *clientOptions) {
+		o.multiAddress = true
+	}
+}
+
+// WithStorageLayout selects how the hosts are stored in etcd, the default is
+// LayoutBlob.
+func WithStorageLayout(layout StorageLayout) ClientOption {
+	return func(o *clientOptions) {
+		o.layout = layout
+	}
+}
+
+// tlsConfig builds the TLS config from the options, it returns nil if TLS is
+// not enabled.
+func (o *clientOptions) tlsConfig() (*tls.Config, error) {
+	if o.ca == "" && o.cert == "" && o.key == "" && !o.insecureSkipVerify {
+		return nil, nil
+	}
+	if (o.cert == "") != (o.key == "") {
+		return nil, errors.New("[etcd/cert] cert and key must be set together")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: o.insecureSkipVerify}
+
+	if o.ca != "" {
+		caBs, err := loadCertData("ca", o.ca)
+		if err != nil {
+			return nil, err
+		}
+		rootCertPool := x509.NewCertPool()
+		if !rootCertPool.AppendCertsFromPEM(caBs) {
+			return nil, errors.New("[etcd/cert] no valid certificate found in ca")
+		}
+		tlsConfig.RootCAs = rootCertPool
+	}
+
+	if o.cert != "" {
+		certBs, err := loadCertData("cert", o.cert)
+		if err != nil {
+			return nil, err
+		}
+		keyBs, err := loadCertData("key", o.key)
+		if err != nil {
+			return nil, err
+		}
+		etcdClientCert, err := tls.X509KeyPair(certBs, keyBs)
+		if err != nil {
+			return nil, fmt.Errorf("[etcd/cert] x509 error: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{etcdClientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertData reads a cert config which is either a filepath or base64 data.
+func loadCertData(name, value string) ([]byte, error) {
+	// if config is filepath, replace "~" to real home dir
+	value, err := expandHome(value)
+	if err != nil {
+		return nil, err
+	}
+
+	// check config is base64 data or filepath
+	if _, err = os.Stat(value); err == nil {
+		bs, err := ioutil.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("[etcd/cert] read %s file %s failed: %w", name, value, err)
+		}
+		return bs, nil
+	}
+
+	bs, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("[etcd/cert] %s base64 decode failed: %w", name, err)
+	}
+	return bs, nil
+}
@@ -0,0 +1,192 @@
+package etcdhosts_client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ParseErrorKind classifies a ParseError.
+type ParseErrorKind int
+
+const (
+	ParseErrInvalidIP ParseErrorKind = iota
+	ParseErrInvalidDomain
+	ParseErrMissingDomain
+	ParseErrDuplicate
+	ParseErrConflict
+)
+
+func (k ParseErrorKind) String() string {
+	switch k {
+	case ParseErrInvalidIP:
+		return "invalid ip"
+	case ParseErrInvalidDomain:
+		return "invalid domain"
+	case ParseErrMissingDomain:
+		return "missing domain"
+	case ParseErrDuplicate:
+		return "duplicate entry"
+	case ParseErrConflict:
+		return "conflicting entry"
+	}
+	return fmt.Sprintf("ParseErrorKind(%d)", int(k))
+}
+
+// ParseError is a problem found on a line of a hosts file. Depending on its
+// Kind and ParseOptions.Strict it is either fatal or reported as a warning by
+// HostFile.Warnings.
+type ParseError struct {
+	// Line and Column are 1-based, Column points at Text.
+	Line   int
+	Column int
+	// Text is the offending field, or the whole line for ParseErrMissingDomain.
+	Text string
+	Kind ParseErrorKind
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("line %d, column %d: %s %q: %v", e.Line, e.Column, e.Kind, e.Text, e.Err)
+	}
+	return fmt.Sprintf("line %d, column %d: %s %q", e.Line, e.Column, e.Kind, e.Text)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseErrors is returned by NewHostFileWithOptions if more than one line
+// failed to parse. errors.As with a *ParseError target yields the first one.
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return "failed to create hostfile: " + strings.Join(msgs, "; ")
+}
+
+// As implements errors.As for *ParseError targets.
+func (e ParseErrors) As(target interface{}) bool {
+	if t, ok := target.(**ParseError); ok && len(e) > 0 {
+		*t = e[0]
+		return true
+	}
+	return false
+}
+
+// errorOf returns errs as a single error, nil if errs is empty.
+func (e ParseErrors) errorOf() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
+
+// lineField is a whitespace separated field of a line, col is its 1-based
+// position in the line.
+type lineField struct {
+	text string
+	col  int
+}
+
+// splitLine breaks a hosts file line into its fields: a leading "#" disables
+// the line and the text after the next "#" is the trailing comment.
+func splitLine(line string) (enabled bool, fields []lineField, comment string) {
+	enabled = true
+	start := 0
+	if strings.HasPrefix(line, "#") {
+		enabled = false
+		start = 1
+	}
+	end := len(line)
+	if i := strings.Index(line[start:], "#"); i >= 0 {
+		end = start + i
+		comment = line[end+1:]
+	}
+
+	for i := start; i < end; {
+		if line[i] == ' ' || line[i] == '\t' || line[i] == '\r' {
+			i++
+			continue
+		}
+		j := i
+		for j < end && line[j] != ' ' && line[j] != '\t' && line[j] != '\r' {
+			j++
+		}
+		fields = append(fields, lineField{text: line[i:j], col: i + 1})
+		i = j
+	}
+	return enabled, fields, comment
+}
+
+// parsedLine is the result of parseLine, cols holds the column of the domain
+// of each Hostname.
+type parsedLine struct {
+	enabled   bool
+	hostnames HostList
+	cols      []int
+	errs      []*ParseError
+}
+
+// parseLine parses line number lineNo. Domains rejected by NewHostname are
+// left out, a Hostname whose domain only fails the check selected by
+// validation is still returned together with its error, so lenient parsing
+// can keep it.
+func parseLine(line string, lineNo int, validation DomainValidation) parsedLine {
+	// the marker of enabled wildcard entries, see Hostname.Format
+	offset := 0
+	if strings.HasPrefix(line, wildcardMarker) {
+		offset = len(wildcardMarker)
+	}
+	enabled, fields, comment := splitLine(line[offset:])
+	for i := range fields {
+		fields[i].col += offset
+	}
+	parsed := parsedLine{enabled: enabled}
+	if len(fields) == 0 {
+		return parsed
+	}
+
+	ip := fields[0]
+	if len(fields) == 1 {
+		parsed.errs = []*ParseError{{Line: lineNo, Column: ip.col, Text: strings.TrimSpace(line), Kind: ParseErrMissingDomain}}
+		return parsed
+	}
+
+	for _, domain := range fields[1:] {
+		hostname, err := NewHostname(domain.text, ip.text, enabled)
+		if errors.Is(err, ErrInvalidDomain) {
+			parsed.errs = append(parsed.errs, &ParseError{Line: lineNo, Column: domain.col, Text: domain.text, Kind: ParseErrInvalidDomain, Err: err})
+			continue
+		}
+		if err != nil {
+			parsed.hostnames, parsed.cols = nil, nil
+			parsed.errs = []*ParseError{{Line: lineNo, Column: ip.col, Text: ip.text, Kind: ParseErrInvalidIP, Err: err}}
+			return parsed
+		}
+		if err = ValidateDomain(hostname.Domain, validation); err != nil {
+			parsed.errs = append(parsed.errs, &ParseError{Line: lineNo, Column: domain.col, Text: domain.text, Kind: ParseErrInvalidDomain, Err: err})
+		}
+		hostname.SetComment(comment)
+		parsed.hostnames = append(parsed.hostnames, hostname)
+		parsed.cols = append(parsed.cols, domain.col)
+	}
+	return parsed
+}
+
+// addError converts an error returned by HostList.Add into a ParseError.
+func addError(err error, lineNo int, hostname *Hostname, col int) *ParseError {
+	kind := ParseErrConflict
+	if errors.Is(err, ErrDuplicateHostname) {
+		kind = ParseErrDuplicate
+	}
+	return &ParseError{Line: lineNo, Column: col, Text: hostname.Domain, Kind: kind, Err: err}
+}
@@ -0,0 +1,307 @@
+package etcdhosts_client
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Resolver answers forward and reverse lookups against a HostList without
+// scanning it, the mutating methods only update the index entries of the
+// domain and addresses they change. It is meant for agents answering many
+// queries, e.g. from the hosts of a WatchHosts event:
+//
+//	resolver.SetHosts(event.HostFile.Hosts)
+//
+// Like the hosts backend of the system resolver only enabled entries are
+// used. A Resolver is safe for concurrent use.
+type Resolver struct {
+	mu sync.RWMutex
+	// byDomain holds the Hostnames of each lower case domain in list order,
+	// wildcards are stored under their pattern, e.g. "*.preview.internal"
+	byDomain map[string][]*Hostname
+	// byAddr holds the Hostnames of each address, keyed by addrKey
+	byAddr map[string][]*Hostname
+	// order holds the list position of every Hostname, next is the position
+	// of the next added one
+	order map[*Hostname]int
+	next  int
+}
+
+// NewResolver creates a Resolver for a copy of hosts.
+func NewResolver(hosts HostList) *Resolver {
+	r := &Resolver{}
+	r.SetHosts(hosts)
+	return r
+}
+
+// SetHosts replaces all hosts of the Resolver with a copy of hosts.
+func (r *Resolver) SetHosts(hosts HostList) {
+	copied := make(HostList, 0, len(hosts))
+	order := make(map[*Hostname]int, len(hosts))
+	for i, hostname := range hosts {
+		c := cloneHostname(hostname)
+		copied = append(copied, c)
+		order[c] = i
+	}
+	byDomain, byAddr := indexHosts(copied)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byDomain, r.byAddr, r.order, r.next = byDomain, byAddr, order, len(copied)
+}
+
+// Hosts returns a copy of the hosts of the Resolver.
+func (r *Resolver) Hosts() HostList {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	hosts := make(HostList, 0, len(r.order))
+	for _, hostnames := range r.byDomain {
+		for _, hostname := range hostnames {
+			hosts = append(hosts, hostname)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return r.order[hosts[i]] < r.order[hosts[j]]
+	})
+	for i, hostname := range hosts {
+		hosts[i] = cloneHostname(hostname)
+	}
+	return hosts
+}
+
+// Resolve returns the addresses of name like HostList.Resolve: entries for
+// name itself take precedence over the wildcard with the longest matching
+// suffix, and IPv4 addresses come before IPv6 ones.
+func (r *Resolver) Resolve(name string) []net.IP {
+	name = strings.ToLower(canonicalDomain(strings.TrimSuffix(name, ".")))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if ips := resolvedIPs(r.byDomain[name]); len(ips) > 0 {
+		return ips
+	}
+	// "a.b.example" tries "*.b.example" and then "*.example"
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if ips := resolvedIPs(r.byDomain[wildcardPrefix+name]); len(ips) > 0 {
+			return ips
+		}
+	}
+	return nil
+}
+
+// LookupAddr returns the domains of the enabled entries for ip, see
+// HostList.LookupAddr.
+func (r *Resolver) LookupAddr(ip net.IP) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return lookupNames(r.byAddr[addrKey(ip)])
+}
+
+// Add adds hostname like HostList.Add.
+func (r *Resolver) Add(hostname *Hostname) error {
+	return r.add(hostname, false)
+}
+
+// AddAddress adds hostname like HostList.AddAddress.
+func (r *Resolver) AddAddress(hostname *Hostname) error {
+	return r.add(hostname, true)
+}
+
+func (r *Resolver) add(hostname *Hostname, multi bool) error {
+	domain := strings.ToLower(canonicalDomain(hostname.Domain))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// only the Hostnames of the domain can be replaced, so Add works on them
+	// like on the whole list
+	old := r.byDomain[domain]
+	hostnames := append(HostList(nil), old...)
+	err := hostnames.add(hostname, multi)
+
+	kept := make(map[*Hostname]bool, len(hostnames))
+	for _, h := range hostnames {
+		kept[h] = true
+	}
+	for _, h := range old {
+		if !kept[h] {
+			r.unindexAddr(h)
+		}
+	}
+	for i, h := range hostnames {
+		if _, ok := r.order[h]; ok {
+			continue
+		}
+		// a replacing Hostname takes the list position of the replaced one
+		if i < len(old) && !kept[old[i]] {
+			r.order[h] = r.order[old[i]]
+		} else {
+			r.order[h] = r.next
+			r.next++
+		}
+		r.indexAddr(h)
+	}
+	for _, h := range old {
+		if !kept[h] {
+			delete(r.order, h)
+		}
+	}
+	r.setDomain(domain, hostnames)
+	return err
+}
+
+// RemoveDomain removes the entries of domain like HostList.RemoveDomain.
+func (r *Resolver) RemoveDomain(domain string) int {
+	return r.remove(domain, 0)
+}
+
+// RemoveDomainV removes the entries of domain and IP version like
+// HostList.RemoveDomainV.
+func (r *Resolver) RemoveDomainV(domain string, version int) int {
+	if version != 4 && version != 6 {
+		panic(ErrInvalidVersionArg)
+	}
+	return r.remove(domain, version)
+}
+
+// remove removes the Hostnames of domain, of any IP version if version is 0.
+func (r *Resolver) remove(domain string, version int) int {
+	domain = strings.ToLower(canonicalDomain(domain))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var kept HostList
+	removed := 0
+	for _, hostname := range r.byDomain[domain] {
+		if version != 0 && hostname.IPv6 != (version == 6) {
+			kept = append(kept, hostname)
+			continue
+		}
+		r.unindexAddr(hostname)
+		delete(r.order, hostname)
+		removed++
+	}
+	r.setDomain(domain, kept)
+	return removed
+}
+
+// Enable enables the entries of domain like HostList.Enable.
+func (r *Resolver) Enable(domain string) error {
+	return r.setEnabled(domain, true)
+}
+
+// Disable disables the entries of domain like HostList.Disable.
+func (r *Resolver) Disable(domain string) error {
+	return r.setEnabled(domain, false)
+}
+
+func (r *Resolver) setEnabled(domain string, enabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hostnames := HostList(r.byDomain[strings.ToLower(canonicalDomain(domain))])
+	return hostnames.setEnabled(domain, 0, enabled)
+}
+
+// setDomain stores the Hostnames of domain. The caller must hold the write
+// lock.
+func (r *Resolver) setDomain(domain string, hostnames HostList) {
+	if len(hostnames) == 0 {
+		delete(r.byDomain, domain)
+		return
+	}
+	r.byDomain[domain] = hostnames
+}
+
+// indexAddr adds hostname to byAddr in list order. The caller must hold the
+// write lock.
+func (r *Resolver) indexAddr(hostname *Hostname) {
+	key := addrKey(hostname.IP)
+	hostnames := r.byAddr[key]
+	i := sort.Search(len(hostnames), func(i int) bool {
+		return r.order[hostnames[i]] > r.order[hostname]
+	})
+	hostnames = append(hostnames, nil)
+	copy(hostnames[i+1:], hostnames[i:])
+	hostnames[i] = hostname
+	r.byAddr[key] = hostnames
+}
+
+// unindexAddr removes hostname from byAddr. The caller must hold the write
+// lock.
+func (r *Resolver) unindexAddr(hostname *Hostname) {
+	key := addrKey(hostname.IP)
+	hostnames := r.byAddr[key]
+	for i, h := range hostnames {
+		if h == hostname {
+			hostnames = append(hostnames[:i:i], hostnames[i+1:]...)
+			break
+		}
+	}
+	if len(hostnames) == 0 {
+		delete(r.byAddr, key)
+		return
+	}
+	r.byAddr[key] = hostnames
+}
+
+func indexHosts(hosts HostList) (byDomain, byAddr map[string][]*Hostname) {
+	byDomain = make(map[string][]*Hostname, len(hosts))
+	byAddr = make(map[string][]*Hostname, len(hosts))
+	for _, hostname := range hosts {
+		domain := strings.ToLower(hostname.Domain)
+		byDomain[domain] = append(byDomain[domain], hostname)
+		byAddr[addrKey(hostname.IP)] = append(byAddr[addrKey(hostname.IP)], hostname)
+	}
+	return byDomain, byAddr
+}
+
+// addrKey is the key of ip in Resolver.byAddr, IPv4 and IPv4-mapped
+// addresses share a key like they are equal for net.IP.
+func addrKey(ip net.IP) string {
+	return string(ip.To16())
+}
+
+// resolvedIPs returns the addresses of the enabled hostnames, IPv4 before
+// IPv6 and otherwise in list order.
+func resolvedIPs(hostnames []*Hostname) []net.IP {
+	var ips []net.IP
+	for _, ipv6 := range []bool{false, true} {
+		for _, hostname := range hostnames {
+			if hostname.Enabled && hostname.IPv6 == ipv6 {
+				ips = append(ips, hostname.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// lookupNames returns the domains of the enabled hostnames in list order,
+// leaving out wildcards and repeated domains.
+func lookupNames(hostnames []*Hostname) []string {
+	var names []string
+	for _, hostname := range hostnames {
+		if !hostname.Enabled || hostname.IsWildcard() {
+			continue
+		}
+		repeated := false
+		for _, name := range names {
+			if strings.EqualFold(name, hostname.Domain) {
+				repeated = true
+				break
+			}
+		}
+		if !repeated {
+			names = append(names, hostname.Domain)
+		}
+	}
+	return names
+}
+
+func cloneHostname(hostname *Hostname) *Hostname {
+	c := *hostname
+	c.IP = append(net.IP(nil), hostname.IP...)
+	c.copyAnnotations(hostname)
+	return &c
+}
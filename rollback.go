@@ -0,0 +1,73 @@
+package etcdhosts_client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// rollbackMarker is written as the first line of a version created by
+// Rollback. It is a comment, so it is ignored when the hosts are parsed.
+const rollbackMarker = "# etcdhosts: rollback of revision %d"
+
+// Rollback writes the hosts as they were at revision back as a new version.
+// The write is guarded by a compare-and-swap against the current revision, so
+// a concurrent push makes Rollback fail with a *RevisionConflictError instead
+// of being overwritten. The new version records the revision it was rolled
+// back to, see HostFile.RollbackOf. Rollback returns the revision of the new
+// version.
+func (hc *HostsClient) Rollback(ctx context.Context, revision int64) (int64, error) {
+	if revision < 1 {
+		return 0, fmt.Errorf("[etcd/client/rollback] invalid revision %d", revision)
+	}
+
+	target, err := hc.GetHostsWithRevisionContext(ctx, revision)
+	if err != nil {
+		return 0, fmt.Errorf("[etcd/client/rollback] get hosts at revision %d failed: %w", revision, err)
+	}
+
+	var modRevision int64
+	current, err := hc.GetVHostsContext(ctx)
+	if err != nil && !errors.Is(err, ErrHostsNotExist) {
+		return 0, fmt.Errorf("[etcd/client/rollback] get current hosts failed: %w", err)
+	}
+	if current != nil {
+		modRevision = current.Revision
+	}
+
+	return hc.putHostsIfRevision(ctx, target, fmt.Sprintf(rollbackMarker+"\n", revision), modRevision)
+}
+
+// RollbackOf returns the revision this HostFile was rolled back to if it was
+// written by HostsClient.Rollback, otherwise it returns 0.
+func (h *HostFile) RollbackOf() int64 {
+	// a HostFile read with ParseHostFile has no data, only the header
+	header := h.header
+	for _, line := range strings.Split(string(h.data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			header = line
+			break
+		}
+	}
+	var revision int64
+	if _, err := fmt.Sscanf(header, rollbackMarker, &revision); err != nil {
+		return 0
+	}
+	return revision
+}
+
+// stripRollbackMarker removes the rollback marker from the first line of
+// data, so it is not carried over to later versions.
+func stripRollbackMarker(data []byte) []byte {
+	line := data
+	if index := bytes.IndexByte(data, '\n'); index > -1 {
+		line = data[:index]
+	}
+	var revision int64
+	if _, err := fmt.Sscanf(string(bytes.TrimSpace(line)), rollbackMarker, &revision); err != nil {
+		return data
+	}
+	return bytes.TrimPrefix(data[len(line):], []byte("\n"))
+}
@@ -0,0 +1,576 @@
+package etcdhosts_client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+// ErrTooManyEntryChanges is returned when the etcd server rejects even the
+// transactions of entryTxnOps operations a large write with LayoutEntries is
+// split into, raise its --max-txn-ops to at least the default of 128.
+var ErrTooManyEntryChanges = errors.New("too many entry changes for one transaction")
+
+// StorageLayout selects how a HostsClient stores the hosts in etcd.
+type StorageLayout int
+
+const (
+	// LayoutBlob stores the whole hosts file as a single value under the
+	// hosts key.
+	LayoutBlob StorageLayout = iota
+	// LayoutEntries stores every Hostname as JSON under
+	// "<hostKey>/<domain>/<4|6>". Every write also touches the hosts key
+	// itself, its ModRevision and Version act as revision and version of the
+	// whole set of entries. Writes too large for a single transaction store
+	// a new generation of the entries under
+	// "<hostKey>/_generation/<id>/<domain>/<4|6>" and switch to it by setting
+	// "<hostKey>/_generation" to the id.
+	LayoutEntries
+)
+
+// generationName names the key below the hosts key which holds the id of
+// the current generation of the entries, and the directory the entries of
+// the generations are stored in. ValidateDomain rejects it as a domain.
+const generationName = "_generation"
+
+// entryTxnOps is the number of operations of the transactions a new
+// generation of the entries is written with, the default --max-txn-ops of
+// etcd.
+const entryTxnOps = 128
+
+// generationKey returns the key holding the current generation, if it does
+// not exist the entries are stored directly below the hosts key.
+func (hc *HostsClient) generationKey() string {
+	return hc.subKeyPrefix() + generationName
+}
+
+// entryPrefix returns the prefix of the entry keys of generation.
+func (hc *HostsClient) entryPrefix(generation string) string {
+	if generation == "" {
+		return hc.subKeyPrefix()
+	}
+	return hc.generationKey() + "/" + generation + "/"
+}
+
+// entryKey returns the key of hostname in generation with LayoutEntries.
+// Domains are case-insensitive, so the key holds the lowercase domain.
+func (hc *HostsClient) entryKey(generation, domain, version string) string {
+	return hc.entryPrefix(generation) + entryName(domain, version)
+}
+
+// entryName returns the name of an entry key below the prefix of its
+// generation.
+func entryName(domain, version string) string {
+	return strings.ToLower(domain) + "/" + version
+}
+
+// parseEntryKey returns the generation, domain and IP version of an entry
+// key, ok is false if key is not an entry of this client.
+func (hc *HostsClient) parseEntryKey(key string) (generation, domain string, version int, ok bool) {
+	if !strings.HasPrefix(key, hc.subKeyPrefix()) || hc.isEphemeralKey(key) {
+		return "", "", 0, false
+	}
+	name := strings.TrimPrefix(key, hc.subKeyPrefix())
+	if strings.HasPrefix(name, generationName+"/") {
+		name = strings.TrimPrefix(name, generationName+"/")
+		index := strings.IndexByte(name, '/')
+		if index < 1 {
+			return "", "", 0, false
+		}
+		generation, name = name[:index], name[index+1:]
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", 0, false
+	}
+	switch parts[1] {
+	case "4":
+		return generation, parts[0], 4, true
+	case "6":
+		return generation, parts[0], 6, true
+	}
+	return "", "", 0, false
+}
+
+func ipVersion(hostname *Hostname) string {
+	if hostname.IPv6 {
+		return "6"
+	}
+	return "4"
+}
+
+// subKeyPrefix is the prefix of the entries and registrations below the
+// hosts key. Unlike the hosts key itself it does not match other keys
+// starting with the same name, e.g. "/hosts-prod" for "/hosts".
+func (hc *HostsClient) subKeyPrefix() string {
+	return hc.hostKey + "/"
+}
+
+// getHostKeys reads the hosts key and its sub keys at revision, 0 reads the
+// latest revision. Both are read in one transaction, so they are consistent,
+// and the revision they were read at is returned.
+func (hc *HostsClient) getHostKeys(ctx context.Context, revision int64) ([]*mvccpb.KeyValue, int64, error) {
+	var opts []clientv3.OpOption
+	if revision > 0 {
+		opts = append(opts, clientv3.WithRev(revision))
+	}
+	resp, err := hc.cli.Txn(ctx).Then(
+		clientv3.OpGet(hc.hostKey, opts...),
+		clientv3.OpGet(hc.subKeyPrefix(), append(opts, clientv3.WithPrefix())...),
+	).Commit()
+	if err != nil {
+		return nil, 0, err
+	}
+	var kvs []*mvccpb.KeyValue
+	for _, r := range resp.Responses {
+		kvs = append(kvs, r.GetResponseRange().Kvs...)
+	}
+	return kvs, resp.Header.Revision, nil
+}
+
+// entrySet is the hosts key and the entries of the current generation
+// among the keys read by getHostKeys.
+type entrySet struct {
+	// hostKey is nil if the hosts key does not exist
+	hostKey    *mvccpb.KeyValue
+	generation string
+	entries    []*mvccpb.KeyValue
+	// legacy holds the entries stored directly below the hosts key while
+	// another generation is current, they are left over from a switch
+	legacy []*mvccpb.KeyValue
+}
+
+func (hc *HostsClient) newEntrySet(kvs []*mvccpb.KeyValue) *entrySet {
+	set := &entrySet{}
+	for _, kv := range kvs {
+		switch string(kv.Key) {
+		case hc.hostKey:
+			set.hostKey = kv
+		case hc.generationKey():
+			set.generation = string(kv.Value)
+		}
+	}
+	for _, kv := range kvs {
+		generation, _, _, ok := hc.parseEntryKey(string(kv.Key))
+		switch {
+		case !ok:
+		case generation == set.generation:
+			set.entries = append(set.entries, kv)
+		case generation == "":
+			set.legacy = append(set.legacy, kv)
+		}
+	}
+	return set
+}
+
+// modRevision returns the ModRevision of the hosts key, 0 if it does not
+// exist, which is what a compare against a missing key sees.
+func (set *entrySet) modRevision() int64 {
+	if set.hostKey == nil {
+		return 0
+	}
+	return set.hostKey.ModRevision
+}
+
+// getEntries assembles the hosts from the entry keys at revision, 0 reads
+// the latest revision. The data of the returned HostFile is the value of the
+// hosts key.
+func (hc *HostsClient) getEntries(ctx context.Context, revision int64) (*VHosts, error) {
+	kvs, _, err := hc.getHostKeys(ctx, revision)
+	if err != nil {
+		return nil, fmt.Errorf("[etcd/client/get] get hosts failed, key %s: %w", hc.hostKey, err)
+	}
+	set := hc.newEntrySet(kvs)
+	if set.hostKey == nil && len(set.entries) == 0 {
+		return nil, fmt.Errorf("[etcd/client/get] %w, key: %s", ErrHostsNotExist, hc.hostKey)
+	}
+
+	vh := &VHosts{HostFile: &HostFile{Hosts: HostList{}}}
+	if set.hostKey != nil {
+		vh.Version = set.hostKey.Version
+		vh.Revision = set.hostKey.ModRevision
+		vh.HostFile.data = set.hostKey.Value
+	}
+	index := newHostIndex(vh.HostFile.Hosts)
+	for _, kv := range set.entries {
+		hostnames, err := decodeHostnames(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("[etcd/client/get] %w, key %s", err, kv.Key)
+		}
+		for _, hostname := range hostnames {
+			_ = vh.HostFile.Hosts.addIndexed(hostname, hc.multiAddress, index)
+		}
+	}
+	vh.HostFile.Hosts.Sort()
+	return vh, nil
+}
+
+// putEntries replaces the entries with the static entries of hostFile and
+// sets the hosts key to header, guarded by modRevision unless it is
+// negative. It returns the revision of the write.
+//
+// Only changed entries are written, in one transaction if the etcd server
+// allows that many operations (its --max-txn-ops). Otherwise all entries are
+// written as a new generation first, in transactions of entryTxnOps
+// operations which are not visible to readers, and a final small transaction
+// switches to that generation. Either way the change becomes visible at
+// once.
+//
+// The changes are computed from the entries read before, so an unguarded
+// write is still guarded by the revision of that read and starts over after
+// a backoff if another write came in between, otherwise entries written
+// concurrently by PutEntry or DeleteEntry could be left behind.
+func (hc *HostsClient) putEntries(ctx context.Context, hostFile *HostFile, header string, modRevision int64) (int64, error) {
+	// the values by the name of their key below the entry prefix, a domain
+	// with several addresses is stored as a JSON array
+	var names []string
+	desired := make(map[string][]*Hostname)
+	for _, hostname := range hostFile.Hosts {
+		if hostname.Ephemeral {
+			continue
+		}
+		name := entryName(hostname.Domain, ipVersion(hostname))
+		if _, ok := desired[name]; !ok {
+			names = append(names, name)
+		}
+		desired[name] = append(desired[name], hostname)
+	}
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		var value []byte
+		var err error
+		if hostnames := desired[name]; len(hostnames) == 1 {
+			value, err = json.Marshal(hostnames[0])
+		} else {
+			value, err = json.Marshal(hostnames)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("[etcd/client/put] marshal hostname failed, key %s: %w", hc.subKeyPrefix()+name, err)
+		}
+		values[name] = string(value)
+	}
+
+	backoff := updateInitialBackoff
+	for {
+		kvs, _, err := hc.getHostKeys(ctx, 0)
+		if err != nil {
+			return 0, fmt.Errorf("[etcd/client/put] get current entries failed, key %s: %w", hc.hostKey, err)
+		}
+		set := hc.newEntrySet(kvs)
+		guard := modRevision
+		if guard < 0 {
+			guard = set.modRevision()
+		}
+
+		revision, err := hc.putChangedEntries(ctx, set, names, values, header, guard)
+		if errors.Is(err, rpctypes.ErrTooManyOps) {
+			revision, err = hc.putGeneration(ctx, set, names, values, header, guard)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if revision > 0 {
+			return revision, nil
+		}
+
+		if modRevision < 0 {
+			if err = waitBackoff(ctx, &backoff); err != nil {
+				return 0, fmt.Errorf("[etcd/client/put] push hosts canceled, key %s: %w", hc.hostKey, err)
+			}
+			continue
+		}
+		conflict := &RevisionConflictError{Key: hc.hostKey, Expected: modRevision}
+		conflict.Current, err = hc.getEntries(ctx, 0)
+		if err != nil && !errors.Is(err, ErrHostsNotExist) {
+			return 0, err
+		}
+		return 0, conflict
+	}
+}
+
+// putChangedEntries writes the entries which differ from set in the current
+// generation in one transaction guarded by guard. It returns 0 if the guard
+// failed and rpctypes.ErrTooManyOps if the transaction is too large.
+func (hc *HostsClient) putChangedEntries(ctx context.Context, set *entrySet, names []string, values map[string]string, header string, guard int64) (int64, error) {
+	prefix := hc.entryPrefix(set.generation)
+	current := make(map[string]string, len(set.entries))
+	for _, kv := range set.entries {
+		current[strings.TrimPrefix(string(kv.Key), prefix)] = string(kv.Value)
+	}
+
+	ops := []clientv3.Op{clientv3.OpPut(hc.hostKey, header)}
+	for _, name := range names {
+		if value, ok := current[name]; !ok || value != values[name] {
+			ops = append(ops, clientv3.OpPut(prefix+name, values[name]))
+		}
+	}
+	for name := range current {
+		if _, ok := values[name]; !ok {
+			ops = append(ops, clientv3.OpDelete(prefix+name))
+		}
+	}
+
+	resp, err := hc.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(hc.hostKey), "=", guard)).
+		Then(ops...).
+		Commit()
+	if errors.Is(err, rpctypes.ErrTooManyOps) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, fmt.Errorf("[etcd/client/put] push hosts failed, key %s: %w", hc.hostKey, err)
+	}
+	if !resp.Succeeded {
+		return 0, nil
+	}
+	return resp.Header.Revision, nil
+}
+
+// putGeneration writes all entries as a new generation and switches to it
+// in a transaction guarded by guard, which also removes the previous
+// generation. It returns 0 if the guard failed.
+func (hc *HostsClient) putGeneration(ctx context.Context, set *entrySet, names []string, values map[string]string, header string, guard int64) (int64, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return 0, fmt.Errorf("[etcd/client/put] create generation failed: %w", err)
+	}
+	generation := hex.EncodeToString(id)
+	prefix := hc.entryPrefix(generation)
+	// removes the new generation if the switch does not happen, the
+	// entries are not visible to readers until then
+	discard := func() {
+		_, _ = hc.cli.Delete(context.Background(), prefix, clientv3.WithPrefix())
+	}
+
+	for start := 0; start < len(names); start += entryTxnOps {
+		end := start + entryTxnOps
+		if end > len(names) {
+			end = len(names)
+		}
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, name := range names[start:end] {
+			ops = append(ops, clientv3.OpPut(prefix+name, values[name]))
+		}
+		_, err := hc.cli.Txn(ctx).Then(ops...).Commit()
+		if errors.Is(err, rpctypes.ErrTooManyOps) {
+			discard()
+			return 0, fmt.Errorf("[etcd/client/put] %w, key %s: %d operations", ErrTooManyEntryChanges, hc.hostKey, len(ops))
+		}
+		if err != nil {
+			discard()
+			return 0, fmt.Errorf("[etcd/client/put] push hosts failed, key %s: %w", hc.hostKey, err)
+		}
+	}
+
+	ops := []clientv3.Op{
+		clientv3.OpPut(hc.hostKey, header),
+		clientv3.OpPut(hc.generationKey(), generation),
+	}
+	if set.generation != "" {
+		ops = append(ops, clientv3.OpDelete(hc.entryPrefix(set.generation), clientv3.WithPrefix()))
+	}
+	resp, err := hc.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(hc.hostKey), "=", guard)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		discard()
+		return 0, fmt.Errorf("[etcd/client/put] push hosts failed, key %s: %w", hc.hostKey, err)
+	}
+	if !resp.Succeeded {
+		discard()
+		return 0, nil
+	}
+
+	// the entries stored directly below the hosts key share their prefix
+	// with the registrations and the generations, so they are removed one
+	// by one. They are no longer read, a failure only leaves them behind.
+	stale := set.legacy
+	if set.generation == "" {
+		stale = set.entries
+	}
+	for start := 0; start < len(stale); start += entryTxnOps {
+		end := start + entryTxnOps
+		if end > len(stale) {
+			end = len(stale)
+		}
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, kv := range stale[start:end] {
+			ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+		}
+		if _, err = hc.cli.Txn(ctx).Then(ops...).Commit(); err != nil {
+			break
+		}
+	}
+	return resp.Header.Revision, nil
+}
+
+// currentGeneration reads the current generation of the entries and returns
+// it with a comparison which fails once it changed.
+func (hc *HostsClient) currentGeneration(ctx context.Context) (string, clientv3.Cmp, error) {
+	resp, err := hc.cli.Get(ctx, hc.generationKey())
+	if err != nil {
+		return "", clientv3.Cmp{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", clientv3.Compare(clientv3.Version(hc.generationKey()), "=", 0), nil
+	}
+	generation := string(resp.Kvs[0].Value)
+	return generation, clientv3.Compare(clientv3.Value(hc.generationKey()), "=", generation), nil
+}
+
+// PutEntry adds or replaces a single entry without touching the others, so
+// concurrent edits of different domains don't conflict. All addresses of the
+// domain and IP version are replaced by hostname. It is only available
+// with LayoutEntries and returns the revision of the write.
+func (hc *HostsClient) PutEntry(ctx context.Context, hostname *Hostname) (int64, error) {
+	if hc.layout != LayoutEntries {
+		return 0, errors.New("[etcd/client/put] PutEntry requires LayoutEntries")
+	}
+	if !hostname.IsValid() {
+		return 0, fmt.Errorf("[etcd/client/put] invalid hostname %s -> %s", hostname.Domain, hostname.IP)
+	}
+	value, err := json.Marshal(hostname)
+	if err != nil {
+		return 0, fmt.Errorf("[etcd/client/put] marshal hostname failed: %w", err)
+	}
+
+	// a write switching to a new generation in the meantime makes the
+	// entry start over in that generation
+	backoff := updateInitialBackoff
+	for {
+		generation, cmp, err := hc.currentGeneration(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("[etcd/client/put] get generation failed, key %s: %w", hc.generationKey(), err)
+		}
+		key := hc.entryKey(generation, hostname.Domain, ipVersion(hostname))
+		resp, err := hc.cli.Txn(ctx).If(cmp).Then(
+			clientv3.OpPut(key, string(value)),
+			clientv3.OpPut(hc.hostKey, ""),
+		).Commit()
+		if err != nil {
+			return 0, fmt.Errorf("[etcd/client/put] put entry failed, key %s: %w", key, err)
+		}
+		if resp.Succeeded {
+			return resp.Header.Revision, nil
+		}
+		if err = waitBackoff(ctx, &backoff); err != nil {
+			return 0, fmt.Errorf("[etcd/client/put] put entry canceled, key %s: %w", key, err)
+		}
+	}
+}
+
+// DeleteEntry removes the entry of domain and IP version without touching
+// the others. It is only available with LayoutEntries and returns the
+// revision of the write.
+//
+// This function will return ErrInvalidVersionArg if IP version is not 4 or 6,
+// and ErrHostnameNotFound if the entry does not exist, nothing is written
+// then.
+func (hc *HostsClient) DeleteEntry(ctx context.Context, domain string, version int) (int64, error) {
+	if hc.layout != LayoutEntries {
+		return 0, errors.New("[etcd/client/delete] DeleteEntry requires LayoutEntries")
+	}
+	if version != 4 && version != 6 {
+		return 0, ErrInvalidVersionArg
+	}
+
+	backoff := updateInitialBackoff
+	for {
+		generation, cmp, err := hc.currentGeneration(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("[etcd/client/delete] get generation failed, key %s: %w", hc.generationKey(), err)
+		}
+		key := hc.entryKey(generation, domain, fmt.Sprint(version))
+		resp, err := hc.cli.Txn(ctx).
+			If(cmp, clientv3.Compare(clientv3.Version(key), ">", 0)).
+			Then(clientv3.OpDelete(key), clientv3.OpPut(hc.hostKey, "")).
+			Else(clientv3.OpGet(hc.generationKey())).
+			Commit()
+		if err != nil {
+			return 0, fmt.Errorf("[etcd/client/delete] delete entry failed, key %s: %w", key, err)
+		}
+		if resp.Succeeded {
+			return resp.Header.Revision, nil
+		}
+		// the generation is unchanged, so the entry is missing
+		var current string
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			current = string(kvs[0].Value)
+		}
+		if current == generation {
+			return 0, fmt.Errorf("[etcd/client/delete] %w, key %s", ErrHostnameNotFound, key)
+		}
+		if err = waitBackoff(ctx, &backoff); err != nil {
+			return 0, fmt.Errorf("[etcd/client/delete] delete entry canceled, key %s: %w", key, err)
+		}
+	}
+}
+
+// MigrateToEntries converts hosts stored with LayoutBlob into LayoutEntries.
+// The blob under the hosts key is replaced, so clients still using
+// LayoutBlob will no longer see the hosts afterwards. It fails if entries
+// already exist and returns the revision of the migrated hosts.
+func (hc *HostsClient) MigrateToEntries(ctx context.Context) (int64, error) {
+	kvs, _, err := hc.getHostKeys(ctx, 0)
+	if err != nil {
+		return 0, fmt.Errorf("[etcd/client/migrate] get hosts failed, key %s: %w", hc.hostKey, err)
+	}
+
+	var blob *VHosts
+	for _, kv := range kvs {
+		key := string(kv.Key)
+		if _, _, _, ok := hc.parseEntryKey(key); ok || key == hc.generationKey() {
+			return 0, fmt.Errorf("[etcd/client/migrate] entries already exist, key %s", key)
+		}
+		if key != hc.hostKey {
+			continue
+		}
+		hostFile, err := decodeHostFile(kv.Value, hc.multiAddress)
+		if err != nil {
+			return 0, fmt.Errorf("[etcd/client/migrate] parse hosts failed, key %s: %w", key, err)
+		}
+		blob = &VHosts{Version: kv.Version, Revision: kv.ModRevision, HostFile: hostFile}
+	}
+	if blob == nil {
+		return 0, fmt.Errorf("[etcd/client/migrate] %w, key: %s", ErrHostsNotExist, hc.hostKey)
+	}
+
+	return hc.putEntries(ctx, blob.HostFile, "", blob.Revision)
+}
+
+// decodeHostnames decodes the value of an entry key, which holds a JSON
+// array if the domain has several addresses.
+func decodeHostnames(value []byte) ([]*Hostname, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(value), []byte("[")) {
+		hostname, err := decodeHostname(value)
+		if err != nil {
+			return nil, err
+		}
+		return []*Hostname{hostname}, nil
+	}
+
+	var raw []json.RawMessage
+	err := json.Unmarshal(value, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("decode hostname failed: %w", err)
+	}
+	hostnames := make([]*Hostname, 0, len(raw))
+	for _, v := range raw {
+		hostname, err := decodeHostname(v)
+		if err != nil {
+			return nil, err
+		}
+		hostnames = append(hostnames, hostname)
+	}
+	return hostnames, nil
+}
@@ -0,0 +1,152 @@
+package etcdhosts_client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+const (
+	SyncBeginMarker = "# BEGIN etcdhosts"
+	SyncEndMarker   = "# END etcdhosts"
+)
+
+// Syncer keeps a block of a local hosts file in sync with the hosts in etcd.
+// Only the lines between SyncBeginMarker and SyncEndMarker are managed, the
+// rest of the file is left untouched. If the file has no such block it is
+// appended.
+type Syncer struct {
+	Client *HostsClient
+	// Target is the file to update, usually /etc/hosts.
+	Target string
+	// Backup is where the previous content of Target is saved before it is
+	// replaced, an empty Backup disables backups.
+	Backup string
+	// GOOS selects the format of the block, see HostFile.Format.
+	GOOS string
+	// OnError is called with errors that don't stop Run, e.g. watch failures
+	// or a failed write. It may be nil.
+	OnError func(error)
+
+	lastRevision int64
+}
+
+// NewSyncer creates a Syncer which writes to target and keeps a backup at
+// target + ".etcdhosts.bak".
+func NewSyncer(client *HostsClient, target string) *Syncer {
+	return &Syncer{
+		Client: client,
+		Target: target,
+		Backup: target + ".etcdhosts.bak",
+		GOOS:   runtime.GOOS,
+	}
+}
+
+// LastRevision returns the revision of the hosts which were applied last, or
+// 0 if nothing has been applied yet.
+func (s *Syncer) LastRevision() int64 {
+	return atomic.LoadInt64(&s.lastRevision)
+}
+
+// Run watches the hosts and applies every change until ctx is done.
+func (s *Syncer) Run(ctx context.Context) error {
+	for event := range s.Client.WatchHosts(ctx) {
+		if event.Err != nil {
+			s.reportError(event.Err)
+			continue
+		}
+		err := s.Apply(event.HostFile, event.Revision)
+		if err != nil {
+			s.reportError(err)
+		}
+	}
+	return ctx.Err()
+}
+
+// Apply writes hostFile into the managed block of the target file and
+// records revision as the last applied one. The file is only rewritten if its
+// content changes.
+func (s *Syncer) Apply(hostFile *HostFile, revision int64) error {
+	perm := os.FileMode(0644)
+	current, err := ioutil.ReadFile(s.Target)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("[etcd/sync] read %s failed: %w", s.Target, err)
+	}
+	if info, statErr := os.Stat(s.Target); statErr == nil {
+		perm = info.Mode().Perm()
+	}
+
+	block := bytes.Buffer{}
+	block.WriteString(SyncBeginMarker + "\n")
+	hosts := hostFile.Format(s.GOOS)
+	block.Write(hosts)
+	// hosts parsed losslessly keep a missing final newline, the end marker
+	// has to stay on its own line for ReplaceSyncBlock to find the block
+	if len(hosts) > 0 && !bytes.HasSuffix(hosts, []byte("\n")) {
+		block.WriteString("\n")
+	}
+	block.WriteString(SyncEndMarker + "\n")
+
+	updated := ReplaceSyncBlock(current, block.Bytes())
+	if !bytes.Equal(updated, current) {
+		if s.Backup != "" && current != nil {
+			err = writeFileAtomic(s.Backup, current, perm)
+			if err != nil {
+				return fmt.Errorf("[etcd/sync] backup %s failed: %w", s.Target, err)
+			}
+		}
+		err = writeFileAtomic(s.Target, updated, perm)
+		if err != nil {
+			return fmt.Errorf("[etcd/sync] update %s failed: %w", s.Target, err)
+		}
+	}
+
+	atomic.StoreInt64(&s.lastRevision, revision)
+	return nil
+}
+
+func (s *Syncer) reportError(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+// ReplaceSyncBlock replaces the lines from SyncBeginMarker to SyncEndMarker
+// (inclusive) in content with block. If content has no complete block, block
+// is appended.
+func ReplaceSyncBlock(content, block []byte) []byte {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	begin, end := -1, -1
+	for i, line := range lines {
+		trimmed := string(bytes.TrimSpace(line))
+		if begin < 0 && trimmed == SyncBeginMarker {
+			begin = i
+		} else if begin >= 0 && trimmed == SyncEndMarker {
+			end = i
+			break
+		}
+	}
+
+	out := bytes.Buffer{}
+	if begin < 0 || end < 0 {
+		out.Write(content)
+		if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+			out.WriteString("\n")
+		}
+		out.Write(block)
+		return out.Bytes()
+	}
+
+	for _, line := range lines[:begin] {
+		out.Write(line)
+	}
+	out.Write(block)
+	for _, line := range lines[end+1:] {
+		out.Write(line)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,95 @@
+package etcdhosts_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	updateMaxRetries     = 10
+	updateInitialBackoff = 50 * time.Millisecond
+	updateMaxBackoff     = 2 * time.Second
+)
+
+// Update performs a read-modify-write cycle against etcd: it reads the current
+// hosts, calls fn to mutate them and writes the result back with
+// PutHostsIfRevision. If the key was changed in the meantime the whole cycle is
+// retried with exponential backoff, so fn may be called more than once and
+// should only depend on the HostFile it is given. If the key does not exist yet,
+// fn receives an empty HostFile.
+//
+// Update returns the committed hosts, whose Revision is the revision of the
+// new version.
+func (hc *HostsClient) Update(ctx context.Context, fn func(*HostFile) error) (*VHosts, error) {
+	current, err := hc.getUpdateBase(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := updateInitialBackoff
+	for i := 0; ; i++ {
+		err = fn(current.HostFile)
+		if err != nil {
+			return nil, err
+		}
+
+		putCtx, cancel := context.WithTimeout(ctx, hc.requestTimeout)
+		revision, err := hc.PutHostsIfRevisionContext(putCtx, current.HostFile, current.Revision)
+		cancel()
+		if err == nil {
+			return &VHosts{
+				Version:  current.Version + 1,
+				Revision: revision,
+				HostFile: current.HostFile,
+			}, nil
+		}
+
+		var conflict *RevisionConflictError
+		if !errors.As(err, &conflict) {
+			return nil, err
+		}
+		if i+1 >= updateMaxRetries {
+			return nil, fmt.Errorf("[etcd/client/update] giving up after %d attempts: %w", updateMaxRetries, err)
+		}
+
+		if err = waitBackoff(ctx, &backoff); err != nil {
+			return nil, fmt.Errorf("[etcd/client/update] update hosts canceled, key %s: %w", hc.hostKey, err)
+		}
+
+		// the conflict already carries the latest remote hosts, so there is
+		// no need for another round trip unless the key has been deleted
+		if conflict.Current != nil {
+			current = conflict.Current
+		} else {
+			current = &VHosts{HostFile: &HostFile{Hosts: HostList{}}}
+		}
+	}
+}
+
+func (hc *HostsClient) getUpdateBase(ctx context.Context) (*VHosts, error) {
+	getCtx, cancel := context.WithTimeout(ctx, hc.requestTimeout)
+	defer cancel()
+
+	current, err := hc.GetVHostsContext(getCtx)
+	if errors.Is(err, ErrHostsNotExist) {
+		return &VHosts{HostFile: &HostFile{Hosts: HostList{}}}, nil
+	}
+	return current, err
+}
+
+// waitBackoff waits for *backoff before a retry and doubles it up to
+// updateMaxBackoff, it returns the error of ctx if ctx is done before.
+func waitBackoff(ctx context.Context, backoff *time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(*backoff):
+	}
+	*backoff *= 2
+	if *backoff > updateMaxBackoff {
+		*backoff = updateMaxBackoff
+	}
+	return nil
+}
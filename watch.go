@@ -0,0 +1,299 @@
+package etcdhosts_client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+const watchRetryInterval = time.Second
+
+// HostsEvent is a decoded change of the hosts delivered by WatchHosts.
+type HostsEvent struct {
+	// Revision is the revision of the change, or the revision the hosts
+	// were read at for resync events.
+	Revision int64
+	// HostFile is the static hosts merged with the registered ephemeral
+	// entries, it is nil if Err is set.
+	HostFile *HostFile
+	// Deleted is set if the static hosts key does not exist, HostFile then
+	// only holds the ephemeral entries.
+	Deleted bool
+	// Changes lists the entries changed by this event with LayoutEntries, it
+	// is empty for resync events.
+	Changes []EntryChange
+	// Err reports a failure of the watch or of decoding a value, the watch
+	// keeps running and recovers by itself.
+	Err error
+}
+
+// EntryChange is a change of a single entry stored with LayoutEntries.
+type EntryChange struct {
+	Domain  string
+	Version int
+	// Hostname is nil if the entry was deleted. If the domain has several
+	// addresses it is the first one and Hostnames holds all of them.
+	Hostname  *Hostname
+	Hostnames []*Hostname
+}
+
+// hostsState is the view of the hosts key and its sub keys that WatchHosts
+// keeps up to date.
+type hostsState struct {
+	static    *HostFile
+	entries   map[string][]*Hostname
+	ephemeral map[string]*Hostname
+	changes   []EntryChange
+	// generation is the generation of the entries in entries, resync is set
+	// once another generation becomes current
+	generation string
+	resync     bool
+	// multiAddress is passed on to decodeHostFile, addIndexed and
+	// mergeEphemeral
+	multiAddress bool
+}
+
+func (s *hostsState) event(revision int64) HostsEvent {
+	hostFile := &HostFile{Hosts: HostList{}}
+	if s.static != nil {
+		// parse the value again so every event gets its own copy
+		if parsed, err := decodeHostFile(s.static.data, s.multiAddress); err == nil {
+			hostFile = parsed
+		}
+	}
+	index := newHostIndex(hostFile.Hosts)
+	for _, hostnames := range s.entries {
+		for _, hostname := range hostnames {
+			_ = hostFile.Hosts.addIndexed(hostname, s.multiAddress, index)
+		}
+	}
+	// merge the registrations in the order of their keys, like
+	// GetEphemeralHosts, so the same one wins without multiAddress
+	keys := make([]string, 0, len(s.ephemeral))
+	for key := range s.ephemeral {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ephemeral := make([]*Hostname, 0, len(keys))
+	for _, key := range keys {
+		ephemeral = append(ephemeral, s.ephemeral[key])
+	}
+	mergeEphemeral(hostFile, ephemeral, s.multiAddress)
+	hostFile.Hosts.Sort()
+
+	event := HostsEvent{
+		Revision: revision,
+		HostFile: hostFile,
+		Deleted:  s.static == nil && len(s.entries) == 0,
+		Changes:  s.changes,
+	}
+	s.changes = nil
+	return event
+}
+
+// WatchHosts watches the hosts key, its entries and the registered ephemeral
+// entries and emits decoded events until ctx is done, then the channel is closed. The
+// first event always reflects the current hosts. When the connection is lost
+// the watch resumes from the last seen revision, and if that revision has been
+// compacted in the meantime the current hosts are read again and emitted as a
+// new event.
+func (hc *HostsClient) WatchHosts(ctx context.Context) <-chan HostsEvent {
+	ch := make(chan HostsEvent)
+	go hc.watchHosts(ctx, ch)
+	return ch
+}
+
+func (hc *HostsClient) watchHosts(ctx context.Context, ch chan<- HostsEvent) {
+	defer close(ch)
+
+	state := &hostsState{multiAddress: hc.multiAddress}
+	// next is the revision to resume watching from, 0 means a resync is
+	// required first
+	var next int64
+	for ctx.Err() == nil {
+		if next == 0 {
+			rev, err := hc.resyncHosts(ctx, state)
+			if err != nil {
+				if !hc.sendEvent(ctx, ch, HostsEvent{Err: err}) || !sleepContext(ctx, watchRetryInterval) {
+					return
+				}
+				continue
+			}
+			if !hc.sendEvent(ctx, ch, state.event(rev)) {
+				return
+			}
+			next = rev + 1
+		}
+
+		var ok bool
+		next, ok = hc.watchFrom(ctx, ch, state, next)
+		if !ok {
+			return
+		}
+		// a resync is done right away, it waits by itself if it fails
+		if next != 0 && !sleepContext(ctx, watchRetryInterval) {
+			return
+		}
+	}
+}
+
+// watchFrom watches the hosts key and its sub keys starting at rev until the
+// watch channel is closed or fails. It returns the revision to resume from (0
+// if a resync is required, e.g. after a switch to another generation of the
+// entries) and false if ctx is done.
+func (hc *HostsClient) watchFrom(ctx context.Context, ch chan<- HostsEvent, state *hostsState, rev int64) (int64, bool) {
+	wctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	// a watch covers a single key range, the range from the hosts key up to
+	// its sub keys ("0" follows "/") still includes keys like "/hosts-prod",
+	// which applyEvent ignores
+	keyEnd := clientv3.WithRange(hc.hostKey + "0")
+	for resp := range hc.cli.Watch(wctx, hc.hostKey, keyEnd, clientv3.WithRev(rev)) {
+		if resp.CompactRevision != 0 {
+			return 0, true
+		}
+		if err := resp.Err(); err != nil {
+			err = fmt.Errorf("[etcd/client/watch] watch hosts failed, key %s: %w", hc.hostKey, err)
+			return rev, hc.sendEvent(ctx, ch, HostsEvent{Revision: rev, Err: err})
+		}
+
+		var changed bool
+		var last int64
+		for _, ev := range resp.Events {
+			rev = ev.Kv.ModRevision + 1
+			ok, err := hc.applyEvent(state, ev)
+			if err != nil {
+				if !hc.sendEvent(ctx, ch, HostsEvent{Revision: ev.Kv.ModRevision, Err: err}) {
+					return rev, false
+				}
+				continue
+			}
+			if state.resync {
+				// the entries of the new generation were written before,
+				// only a resync reads them
+				return 0, true
+			}
+			if ok {
+				changed = true
+				last = ev.Kv.ModRevision
+			}
+		}
+		if changed && !hc.sendEvent(ctx, ch, state.event(last)) {
+			return rev, false
+		}
+	}
+	return rev, ctx.Err() == nil
+}
+
+// applyEvent updates state with a watch event, it returns false if the event
+// is not about the hosts.
+func (hc *HostsClient) applyEvent(state *hostsState, ev *clientv3.Event) (bool, error) {
+	key := string(ev.Kv.Key)
+	if key == hc.hostKey {
+		if ev.Type == mvccpb.DELETE {
+			state.static = nil
+			return true, nil
+		}
+		// with LayoutEntries the hosts key only carries the header
+		if hc.layout == LayoutEntries {
+			state.static = &HostFile{Hosts: HostList{}, data: ev.Kv.Value}
+			return true, nil
+		}
+		hostFile, err := decodeHostFile(ev.Kv.Value, hc.multiAddress)
+		if err != nil {
+			return false, fmt.Errorf("[etcd/client/watch] parse hosts failed, key %s: %w", key, err)
+		}
+		state.static = hostFile
+		return true, nil
+	}
+
+	if hc.isEphemeralKey(key) {
+		if ev.Type == mvccpb.DELETE {
+			delete(state.ephemeral, key)
+			return true, nil
+		}
+		hostname, err := decodeHostname(ev.Kv.Value)
+		if err != nil {
+			return false, fmt.Errorf("[etcd/client/watch] %w, key %s", err, key)
+		}
+		state.ephemeral[key] = hostname
+		return true, nil
+	}
+
+	if key == hc.generationKey() {
+		if hc.layout == LayoutEntries && (ev.Type == mvccpb.DELETE || string(ev.Kv.Value) != state.generation) {
+			state.resync = true
+		}
+		return false, nil
+	}
+
+	generation, domain, version, ok := hc.parseEntryKey(key)
+	if !ok || hc.layout != LayoutEntries || generation != state.generation {
+		return false, nil
+	}
+	change := EntryChange{Domain: domain, Version: version}
+	if ev.Type == mvccpb.DELETE {
+		delete(state.entries, key)
+	} else {
+		hostnames, err := decodeHostnames(ev.Kv.Value)
+		if err != nil {
+			return false, fmt.Errorf("[etcd/client/watch] %w, key %s", err, key)
+		}
+		state.entries[key] = hostnames
+		change.Hostname, change.Hostnames = hostnames[0], hostnames
+	}
+	state.changes = append(state.changes, change)
+	return true, nil
+}
+
+// resyncHosts reads the hosts key and its sub keys in one transaction and
+// replaces state, it returns the revision the hosts were read at.
+func (hc *HostsClient) resyncHosts(ctx context.Context, state *hostsState) (int64, error) {
+	getCtx, cancel := context.WithTimeout(ctx, hc.requestTimeout)
+	defer cancel()
+
+	kvs, rev, err := hc.getHostKeys(getCtx, 0)
+	if err != nil {
+		return 0, fmt.Errorf("[etcd/client/watch] resync hosts failed, key %s: %w", hc.hostKey, err)
+	}
+
+	state.static = nil
+	state.entries = make(map[string][]*Hostname)
+	state.ephemeral = make(map[string]*Hostname)
+	state.generation = hc.newEntrySet(kvs).generation
+	state.resync = false
+	for _, kv := range kvs {
+		_, err = hc.applyEvent(state, &clientv3.Event{Type: mvccpb.PUT, Kv: kv})
+		if err != nil {
+			return 0, err
+		}
+	}
+	state.changes = nil
+	return rev, nil
+}
+
+func (hc *HostsClient) sendEvent(ctx context.Context, ch chan<- HostsEvent, event HostsEvent) bool {
+	select {
+	case ch <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleepContext waits for d and returns false if ctx is done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}